@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/inbound"
+)
+
+// Server 基于http的管理接口
+type Server struct {
+	handler inbound.IHandler
+	reload  func() error
+	mux     *http.ServeMux
+	srv     *http.Server
+	done    chan struct{}
+	// public 监听地址不是回环地址，此时未设置token的请求均被拒绝
+	public bool
+}
+
+// NewServer 创建管理接口服务，通过handler获取及管理运行状态。
+// reload用于重新读取配置文件并应用，为nil时重新应用handler当前的配置
+func NewServer(handler inbound.IHandler, reload func() error) *Server {
+	if reload == nil {
+		reload = func() error { return handler.ReloadConfig(handler.Config()) }
+	}
+	s := &Server{handler: handler, reload: reload, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/reload", s.handleReload)
+	s.mux.HandleFunc("/config", s.handleConfig)
+	s.mux.HandleFunc("/groups", s.handleGroups)
+	s.mux.HandleFunc("/log_level", s.handleLogLevel)
+	s.mux.HandleFunc("/traces", s.handleTraces)
+	s.mux.HandleFunc("/cache", s.handleCache)
+	s.mux.HandleFunc("/cache/flush", s.handleCacheFlush)
+	s.mux.HandleFunc("/cache/stats", s.handleCacheStats)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// token随配置重载生效
+	token := s.handler.Config().Admin.Token
+	if token == "" && s.public {
+		writeError(w, http.StatusForbidden, "token is required when listening on non-loopback address")
+		return
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// bearerToken 解析"Authorization: Bearer <token>"头，格式不符时返回空字符串
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// Start 在指定地址启动管理接口
+func (s *Server) Start(listen string) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		s.public = true
+		if s.handler.Config().Admin.Token == "" {
+			logrus.Warnf("admin api listen on non-loopback address %s without token, all requests will be rejected", ln.Addr())
+		}
+	}
+	s.srv = &http.Server{Handler: s}
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		logrus.Infof("admin api listen on %s", ln.Addr())
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("admin api stopped: %+v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop 关闭管理接口
+func (s *Server) Stop() {
+	if s.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		logrus.Warnf("stop admin api failed: %+v", err)
+	}
+	<-s.done
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(val)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
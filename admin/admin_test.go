@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/inbound"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/utils"
+)
+
+func newTestServer(t *testing.T) (*Server, inbound.IHandler) {
+	handler, err := inbound.NewHandler(config.Conf{
+		Cache:  config.CacheConf{Size: 10},
+		Groups: map[string]config.Group{"fallback": {}},
+	})
+	assert.Nil(t, err)
+	t.Cleanup(handler.Stop)
+	return NewServer(handler, nil), handler
+}
+
+func doRequest(s *Server, method, url string, val interface{}) int {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+	if val != nil {
+		_ = json.Unmarshal(rec.Body.Bytes(), val)
+	}
+	return rec.Code
+}
+
+func TestCacheAPI(t *testing.T) {
+	s, handler := newTestServer(t)
+	for _, name := range []string{"qq.com.", "a.qq.com.", "b.cn."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " 60 IN A 1.1.1.1")
+		handler.Cache().Set("", "fallback", req, &dns.Msg{Answer: []dns.RR{rr}})
+	}
+
+	var entries []cache.Entry
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/cache", &entries))
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/cache?name=qq.com&suffix=true", &entries))
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "fallback", entries[0].Group)
+
+	var deleted map[string]int
+	assert.Equal(t, http.StatusBadRequest, doRequest(s, http.MethodDelete, "/cache", nil))
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodDelete, "/cache?name=a.qq.com", &deleted))
+	assert.Equal(t, 1, deleted["deleted"])
+
+	var stats cache.Stats
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/cache/stats", &stats))
+	assert.Equal(t, 2, stats.Size)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(s, http.MethodGet, "/cache/flush", nil))
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodPost, "/cache/flush", &deleted))
+	assert.Equal(t, 2, deleted["deleted"])
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/cache", &entries))
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestServer_StartStop(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Stop() // not started
+	assert.NotNil(t, s.Start("invalid address"))
+	assert.Nil(t, s.Start("127.0.0.1:0"))
+	s.Stop()
+}
+
+func TestManageAPI(t *testing.T) {
+	s, handler := newTestServer(t)
+	t.Run("reload", func(t *testing.T) {
+		assert.Equal(t, http.StatusMethodNotAllowed, doRequest(s, http.MethodGet, "/reload", nil))
+		assert.Equal(t, http.StatusOK, doRequest(s, http.MethodPost, "/reload", nil))
+
+		s := NewServer(handler, func() error { return errors.New("bad config") })
+		var resp map[string]string
+		assert.Equal(t, http.StatusInternalServerError, doRequest(s, http.MethodPost, "/reload", &resp))
+		assert.Equal(t, "bad config", resp["error"])
+	})
+	t.Run("groups", func(t *testing.T) {
+		var infos []outbound.GroupInfo
+		assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/groups", &infos))
+		assert.Equal(t, 1, len(infos))
+		assert.Equal(t, "fallback", infos[0].Name)
+		assert.True(t, infos[0].Fallback)
+	})
+	t.Run("log_level", func(t *testing.T) {
+		defer logrus.SetLevel(logrus.GetLevel())
+		var resp map[string]string
+		assert.Equal(t, http.StatusBadRequest, doRequest(s, http.MethodPut, "/log_level?level=bad", nil))
+		assert.Equal(t, http.StatusOK, doRequest(s, http.MethodPut, "/log_level?level=debug", &resp))
+		assert.Equal(t, "debug", resp["level"])
+		assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+		assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/log_level", &resp))
+		assert.Equal(t, "debug", resp["level"])
+	})
+}
+
+func TestPublicListenRequiresToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	assert.Nil(t, s.Start("0.0.0.0:0"))
+	defer s.Stop()
+	assert.True(t, s.public)
+	assert.Equal(t, http.StatusForbidden, doRequest(s, http.MethodPost, "/reload", nil))
+
+	// loopback address without token is allowed
+	s, _ = newTestServer(t)
+	assert.Nil(t, s.Start("127.0.0.1:0"))
+	defer s.Stop()
+	assert.False(t, s.public)
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/groups", nil))
+}
+
+func TestAuth(t *testing.T) {
+	handler, err := inbound.NewHandler(config.Conf{
+		Groups: map[string]config.Group{"fallback": {}},
+		Admin:  config.AdminConf{Token: "secret"},
+	})
+	assert.Nil(t, err)
+	defer handler.Stop()
+	s := NewServer(handler, nil)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(s, http.MethodGet, "/config", nil))
+	for _, auth := range []string{"secret", "Basic secret", "Bearer other", "Bearersecret"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/config", nil)
+		req.Header.Set("Authorization", auth)
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	conf := config.Conf{}
+	_, err = toml.Decode(rec.Body.String(), &conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "******", conf.Admin.Token)
+	assert.Contains(t, conf.Groups, "fallback")
+}
+
+func TestTracesAPI(t *testing.T) {
+	handler, err := inbound.NewHandler(config.Conf{
+		Groups: map[string]config.Group{"fallback": {}},
+		Trace:  config.TraceConf{Enable: true},
+	})
+	assert.Nil(t, err)
+	defer handler.Stop()
+	s := NewServer(handler, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	handler.ServeDNS(utils.NewFakeRespWriter(), req)
+	handler.ServeDNS(utils.NewFakeRespWriter(), req)
+
+	var traces []map[string]interface{}
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/traces", &traces))
+	assert.Equal(t, 2, len(traces))
+	id := traces[1]["id"].(string)
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/traces?id="+id, &traces))
+	assert.Equal(t, 1, len(traces))
+	assert.Equal(t, id, traces[0]["id"])
+	assert.Equal(t, "z.cn.", traces[0]["question"])
+}
+
+// metricValue 从/metrics的输出中读取指定样本的值
+func metricValue(t *testing.T, s *Server, series string) float64 {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			val, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			assert.Nil(t, err)
+			return val
+		}
+	}
+	return 0
+}
+
+func TestMetricsAPI(t *testing.T) {
+	s, handler := newTestServer(t)
+	hits := metricValue(t, s, "tsdns_cache_hits_total")
+	req := new(dns.Msg)
+	req.SetQuestion("metrics.cn.", dns.TypeMX)
+	rr, _ := dns.NewRR("metrics.cn. 60 IN MX 10 mail.metrics.cn.")
+	handler.Cache().Set("", "fallback", req, &dns.Msg{Answer: []dns.RR{rr}})
+	handler.ServeDNS(utils.NewFakeRespWriter(), req)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	assert.Contains(t, body, `tsdns_queries_total{qtype="MX",group="",result="cache",rcode="NOERROR"} 1`)
+	assert.Contains(t, body, "tsdns_cache_entries 1\n")
+	assert.Contains(t, body, "# TYPE tsdns_cache_evictions_total counter\n")
+	assert.Contains(t, body, "# TYPE tsdns_upstream_request_duration_seconds histogram\n")
+	assert.Equal(t, hits+1, metricValue(t, s, "tsdns_cache_hits_total"))
+
+	// cache is rebuilt on reload, counters keep growing
+	conf := handler.Config()
+	conf.Cache.MinTTL = 10
+	assert.Nil(t, handler.ReloadConfig(conf))
+	assert.Equal(t, float64(0), metricValue(t, s, "tsdns_cache_entries"))
+	assert.Equal(t, hits+1, metricValue(t, s, "tsdns_cache_hits_total"))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(s, http.MethodPost, "/metrics", nil))
+}
@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/wolf-joe/ts-dns/cache"
+)
+
+// handleCache GET列出缓存，DELETE删除缓存。参数name为域名，suffix为true时同时匹配子域名
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	suffix, _ := strconv.ParseBool(r.URL.Query().Get("suffix"))
+	switch r.Method {
+	case http.MethodGet:
+		entries := s.handler.Cache().List(name, suffix)
+		if entries == nil {
+			entries = []cache.Entry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case http.MethodDelete:
+		if name == "" {
+			writeError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": s.handler.Cache().Delete(name, suffix)})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleCacheFlush 清空缓存
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": s.handler.Cache().Flush()})
+}
+
+// handleCacheStats 返回缓存命中、淘汰等统计信息
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.handler.Cache().Stats())
+}
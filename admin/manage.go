@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/utils"
+)
+
+// handleReload 重新加载配置
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := s.reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	logrus.Infof("reload config by admin api success")
+	writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+}
+
+// handleConfig 以toml格式返回当前生效的配置，隐藏管理接口的token
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	conf := s.handler.Config()
+	if conf.Admin.Token != "" {
+		conf.Admin.Token = "******"
+	}
+	w.Header().Set("Content-Type", "application/toml")
+	w.WriteHeader(http.StatusOK)
+	_ = toml.NewEncoder(w).Encode(conf)
+}
+
+// handleGroups 返回所有分组的上游及运行状态
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	infos := make([]outbound.GroupInfo, 0)
+	for _, group := range s.handler.Groups() {
+		infos = append(infos, outbound.Inspect(group))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleLogLevel GET返回当前日志级别，POST/PUT按参数level修改日志级别
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		level, err := logrus.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logrus.SetLevel(level)
+		logrus.Infof("set log level to %s by admin api", level)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": logrus.GetLevel().String()})
+}
+
+// handleTraces 按从新到旧的顺序返回保留的请求时间线，参数id不为空时只返回对应的时间线
+func (s *Server) handleTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	traces := make([]*utils.Trace, 0)
+	for _, trace := range s.handler.Traces() {
+		if id == "" || trace.ID() == id {
+			traces = append(traces, trace)
+		}
+	}
+	writeJSON(w, http.StatusOK, traces)
+}
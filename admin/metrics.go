@@ -0,0 +1,28 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/wolf-joe/ts-dns/metrics"
+)
+
+// handleMetrics 以Prometheus文本格式输出监控指标
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// 缓存随配置重载重建，每次输出时读取当前缓存的容量信息；命中及淘汰计数由cache包在进程内累计
+	stats := s.handler.Cache().Stats()
+	cacheMetrics := metrics.NewRegistry()
+	cacheMetrics.MustRegister(
+		metrics.NewGaugeFunc("tsdns_cache_entries", "Entries in the DNS cache.",
+			func() float64 { return float64(stats.Size) }),
+		metrics.NewGaugeFunc("tsdns_cache_bytes", "Estimated memory used by the DNS cache.",
+			func() float64 { return float64(stats.Bytes) }),
+	)
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = metrics.Default.WriteTo(w)
+	_, _ = cacheMetrics.WriteTo(w)
+}
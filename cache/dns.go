@@ -3,32 +3,57 @@ package cache
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
 	"github.com/valyala/fastrand"
 	"github.com/wolf-joe/ts-dns/config"
 	"github.com/wolf-joe/ts-dns/utils"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	DefaultMinTTL = time.Minute    // DefaultMinTTL 默认dns缓存最小有效期
-	DefaultMaxTTL = 24 * time.Hour // DefaultMaxTTL 默认dns缓存最大有效期
+	DefaultPrefetchWindow = 10 * time.Second // DefaultPrefetchWindow 默认在缓存过期前多久触发预取
+	DefaultMinTTL         = time.Minute      // DefaultMinTTL 默认dns缓存最小有效期
+	DefaultMaxTTL         = 24 * time.Hour   // DefaultMaxTTL 默认dns缓存最大有效期
+	DefaultStaleAnswerTTL = 30 * time.Second // DefaultStaleAnswerTTL 默认过期响应的ttl
+	DefaultNegativeMaxTTL = 3 * time.Hour    // DefaultNegativeMaxTTL 默认否定响应（NXDOMAIN/NODATA）缓存的最大有效期
 )
 
 // IDNSCache cache dns response for dns request
 type IDNSCache interface {
-	// Get find cached response
-	Get(req *dns.Msg) *dns.Msg
-	// Set save response to cache
-	Set(req *dns.Msg, resp *dns.Msg)
+	// Get find cached response, entries of different views are isolated
+	Get(view string, req *dns.Msg) *dns.Msg
+	// GetStale find expired response which still in stale window, ttl of answers is set to stale answer ttl
+	GetStale(view string, req *dns.Msg) *dns.Msg
+	// Set save response produced by group to cache, ttl is limited by the group's cache policy
+	Set(view, group string, req *dns.Msg, resp *dns.Msg)
+	// Migrate copy unexpired items (include stale items) from src, items rejected by keep are skipped.
+	// return the number of migrated items
+	Migrate(src IDNSCache, keep func(view, group string, question dns.Question) bool) int
+	// List return entries whose name equals to name (or is subdomain of name if suffix is true), sorted by name.
+	// all entries are returned if name is empty
+	List(name string, suffix bool) []Entry
+	// Delete remove entries matched like List, return the number of deleted entries. nothing is deleted if name is empty
+	Delete(name string, suffix bool) int
+	// Flush remove all entries, return the number of deleted entries
+	Flush() int
+	// Stats return hit/miss/eviction counters and current size
+	Stats() Stats
+	// SetPrefetchFunc set callback to re-resolve popular entries which are about to expire
+	SetPrefetchFunc(fn PrefetchFunc)
+	// LoadSnapshot read entries from persist file, existing keys are kept. only called at boot, not on config reload
+	LoadSnapshot()
 	// Start life cycle begin
 	Start(cleanTick ...time.Duration)
 	// Stop life cycle end
 	Stop()
 }
 
+// PrefetchFunc 重新解析请求并写入缓存，由缓存在后台调用
+type PrefetchFunc func(view string, req *dns.Msg)
+
 func NewDNSCache(conf config.Conf) (IDNSCache, error) {
 	minTTL, maxTTL := DefaultMinTTL, DefaultMaxTTL
 	if conf.Cache.MinTTL > 0 {
@@ -40,14 +65,85 @@ func NewDNSCache(conf config.Conf) (IDNSCache, error) {
 	if minTTL > maxTTL {
 		return nil, fmt.Errorf("min ttl(%d) larger than max ttl(%d)", conf.Cache.MinTTL, conf.Cache.MaxTTL)
 	}
+	if conf.Cache.StaleTTL < 0 {
+		return nil, fmt.Errorf("invalid stale ttl(%d)", conf.Cache.StaleTTL)
+	}
+	staleAnswerTTL := DefaultStaleAnswerTTL
+	if conf.Cache.StaleAnswerTTL > 0 {
+		staleAnswerTTL = time.Second * time.Duration(conf.Cache.StaleAnswerTTL)
+	}
+	if conf.Cache.PrefetchHits < 0 || conf.Cache.PrefetchWindow < 0 {
+		return nil, fmt.Errorf("invalid prefetch hits(%d) or window(%d)", conf.Cache.PrefetchHits, conf.Cache.PrefetchWindow)
+	}
+	prefetchWindow := DefaultPrefetchWindow
+	if conf.Cache.PrefetchWindow > 0 {
+		prefetchWindow = time.Second * time.Duration(conf.Cache.PrefetchWindow)
+	}
+	negativeMaxTTL := DefaultNegativeMaxTTL
+	if conf.Cache.NegativeMaxTTL > 0 {
+		negativeMaxTTL = time.Second * time.Duration(conf.Cache.NegativeMaxTTL)
+	}
+	if conf.Cache.MaxBytes < 0 {
+		return nil, fmt.Errorf("invalid max bytes(%d)", conf.Cache.MaxBytes)
+	}
+	if conf.Cache.PersistInterval < 0 {
+		return nil, fmt.Errorf("invalid persist interval(%d)", conf.Cache.PersistInterval)
+	}
 	c := &dnsCache{
-		items:   map[string]cacheItem{},
-		lock:    new(sync.RWMutex),
-		stopCh:  make(chan struct{}),
-		stopped: make(chan struct{}),
-		maxSize: conf.Cache.Size,
-		minTTL:  minTTL,
-		maxTTL:  maxTTL,
+		stopCh:   make(chan struct{}),
+		stopped:  make(chan struct{}),
+		maxSize:  conf.Cache.Size,
+		maxBytes: conf.Cache.MaxBytes,
+		minTTL:   minTTL,
+		maxTTL:   maxTTL,
+
+		negativeMaxTTL: negativeMaxTTL,
+
+		persistInterval: time.Second * time.Duration(conf.Cache.PersistInterval),
+
+		staleTTL:       int64(conf.Cache.StaleTTL),
+		staleAnswerTTL: staleAnswerTTL,
+
+		prefetchHits:   uint32(conf.Cache.PrefetchHits),
+		prefetchWindow: int64(prefetchWindow.Seconds()),
+	}
+	// 分组单独配置的缓存策略
+	c.groupPolicies = map[string]ttlPolicy{}
+	for name, group := range conf.Groups {
+		if group.CacheMinTTL == 0 && group.CacheMaxTTL == 0 && !group.DisableCache {
+			continue
+		}
+		policy := c.ttlPolicy("")
+		policy.disable = group.DisableCache
+		if group.CacheMinTTL > 0 {
+			policy.minTTL = time.Second * time.Duration(group.CacheMinTTL)
+		}
+		if group.CacheMaxTTL > 0 {
+			policy.maxTTL = time.Second * time.Duration(group.CacheMaxTTL)
+			if policy.maxTTL < policy.negativeMaxTTL {
+				policy.negativeMaxTTL = policy.maxTTL
+			}
+			// 仅配置max_ttl时，继承的min_ttl不超过max_ttl
+			if group.CacheMinTTL == 0 && policy.minTTL > policy.maxTTL {
+				policy.minTTL = policy.maxTTL
+			}
+		}
+		if policy.minTTL > policy.maxTTL {
+			return nil, fmt.Errorf("min ttl(%s) larger than max ttl(%s) for group %s", policy.minTTL, policy.maxTTL, name)
+		}
+		c.groupPolicies[name] = policy
+	}
+	// 各分片平分容量限制
+	n, now := shardCount(c.maxSize), time.Now().Unix()
+	for i := 0; i < n; i++ {
+		shard, err := newShard(conf.Cache.Eviction, (c.maxSize+n-1)/n, (c.maxBytes+n-1)/n, now)
+		if err != nil {
+			return nil, err
+		}
+		c.shards = append(c.shards, shard)
+	}
+	if c.maxSize > 0 {
+		c.persistFile = conf.Cache.PersistFile
 	}
 	return c, nil
 }
@@ -56,56 +152,167 @@ var (
 	_ IDNSCache = &dnsCache{}
 )
 
+// ttlPolicy 缓存有效期策略
+type ttlPolicy struct {
+	minTTL         time.Duration
+	maxTTL         time.Duration
+	negativeMaxTTL time.Duration
+	disable        bool // 不缓存
+}
+
 type cacheItem struct {
-	resp      *dns.Msg
-	expiredAt int64
+	view        string
+	group       string // 产生该响应的分组
+	question    dns.Question
+	resp        *dns.Msg
+	expiredAt   int64
+	deadline    int64  // 删除时间，即过期时间加上serve-stale窗口
+	ttl         int64  // 写入时的有效期，单位为秒
+	size        int    // 估算的内存占用
+	hits        uint32 // 命中次数，原子操作
+	prefetching uint32 // 是否已触发预取，原子操作
 }
 
 type dnsCache struct {
-	items   map[string]cacheItem
-	lock    *sync.RWMutex
+	shards  []*cacheShard
+	hitCnt  uint64
+	missCnt uint64
 	stopCh  chan struct{}
 	stopped chan struct{}
 
-	maxSize int
-	minTTL  time.Duration
-	maxTTL  time.Duration
+	maxSize  int
+	maxBytes int // 为0时不限制
+	minTTL   time.Duration
+	maxTTL   time.Duration
+
+	negativeMaxTTL time.Duration
+	groupPolicies  map[string]ttlPolicy // 单独配置了缓存策略的分组
+
+	persistFile     string        // 为空时不持久化
+	persistInterval time.Duration // 为0时仅在Stop时写入快照
+
+	staleTTL       int64 // 过期后保留的秒数
+	staleAnswerTTL time.Duration
+
+	prefetchHits   uint32 // 命中次数达到该值时允许预取，为0时禁用
+	prefetchWindow int64  // 剩余ttl不超过该秒数时触发预取
+	prefetchFunc   PrefetchFunc
+}
+
+func (c *dnsCache) cacheKey(view string, req *dns.Msg) string {
+	return Key(view, req)
 }
 
-func (c *dnsCache) cacheKey(req *dns.Msg) string {
+// shard 按key的FNV-1a哈希选择分片
+func (c *dnsCache) shard(key string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// Key 返回请求的缓存key，由视图、域名、请求类型及ECS组成
+func Key(view string, req *dns.Msg) string {
 	question := req.Question[0]
 	key := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
 	if subnet := utils.FormatECS(req); subnet != "" {
 		key += "." + subnet
 	}
+	if view != "" {
+		key = view + "@" + key
+	}
 	return strings.ToLower(key)
 }
 
-func (c *dnsCache) Get(req *dns.Msg) *dns.Msg {
+func (c *dnsCache) Get(view string, req *dns.Msg) *dns.Msg {
 	if c.maxSize <= 0 {
 		return nil
 	}
 	// check cache
-	key := c.cacheKey(req)
-	c.lock.RLock()
-	item, exists := c.items[key]
-	c.lock.RUnlock()
+	key := c.cacheKey(view, req)
+	now := time.Now().Unix()
+	shard := c.shard(key)
+	shard.lock.Lock()
+	item, exists := shard.items[key]
 	if !exists {
+		shard.lock.Unlock()
+		atomic.AddUint64(&c.missCnt, 1)
+		cacheMisses.Inc()
 		return nil
 	}
 	// ttl countdown
-	ttl := item.expiredAt - time.Now().Unix()
+	ttl := item.expiredAt - now
 	if ttl <= 0 {
-		// remove expired item
-		c.lock.Lock()
-		delete(c.items, key)
-		c.lock.Unlock()
+		if now >= item.deadline {
+			// remove expired item
+			shard.remove(key)
+			shard.expiredCnt++
+			cacheExpired.Inc()
+		}
+		shard.lock.Unlock()
+		atomic.AddUint64(&c.missCnt, 1)
+		cacheMisses.Inc()
+		return nil
+	}
+	shard.policy.touch(key)
+	shard.lock.Unlock()
+	atomic.AddUint64(&c.hitCnt, 1)
+	cacheHits.Inc()
+	// prefetch popular item which is about to expire
+	hits := atomic.AddUint32(&item.hits, 1)
+	if c.prefetchHits > 0 && c.prefetchFunc != nil && hits >= c.prefetchHits && ttl <= c.prefetchWindow &&
+		atomic.CompareAndSwapUint32(&item.prefetching, 0, 1) {
+		go c.prefetchFunc(view, req.Copy())
+	}
+	return c.reply(item, req, uint32(ttl), uint32(item.ttl-ttl))
+}
+
+func (c *dnsCache) SetPrefetchFunc(fn PrefetchFunc) {
+	c.prefetchFunc = fn
+}
+
+func (c *dnsCache) GetStale(view string, req *dns.Msg) *dns.Msg {
+	if c.maxSize <= 0 || c.staleTTL <= 0 {
+		return nil
+	}
+	key := c.cacheKey(view, req)
+	shard := c.shard(key)
+	shard.lock.Lock()
+	item, exists := shard.items[key]
+	shard.lock.Unlock()
+	if !exists {
+		return nil
+	}
+	now := time.Now().Unix()
+	if now < item.expiredAt || now >= item.deadline {
 		return nil
 	}
+	return c.reply(item, req, uint32(c.staleAnswerTTL.Seconds()), 0)
+}
+
+// reply 复制缓存的响应作为请求的回复，并重置ttl、打乱ip顺序。
+// answer的ttl设为ttl，authority的ttl扣除已缓存的时长elapsed且不超过ttl
+func (c *dnsCache) reply(item *cacheItem, req *dns.Msg, ttl, elapsed uint32) *dns.Msg {
 	r := item.resp.Copy()
-	r.SetReply(req)
+	r.SetRcode(req, item.resp.Rcode)
 	for i := 0; i < len(r.Answer); i++ {
-		r.Answer[i].Header().Ttl = uint32(ttl)
+		r.Answer[i].Header().Ttl = ttl
+	}
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		if hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+		if hdr.Ttl > ttl {
+			hdr.Ttl = ttl
+		}
 	}
 	// shuffle ip
 	first := uint32(len(r.Answer))
@@ -123,58 +330,156 @@ func (c *dnsCache) Get(req *dns.Msg) *dns.Msg {
 	return r
 }
 
-func (c *dnsCache) Set(req *dns.Msg, resp *dns.Msg) {
-	if c.maxSize <= 0 || resp == nil || len(resp.Answer) == 0 {
+func (c *dnsCache) Set(view, group string, req *dns.Msg, resp *dns.Msg) {
+	if c.maxSize <= 0 || resp == nil {
 		return
 	}
-	// check size
-	c.lock.RLock()
-	length := len(c.items)
-	c.lock.RUnlock()
-	if length >= c.maxSize {
+	policy := c.ttlPolicy(group)
+	if policy.disable {
 		return
 	}
 	// reset ttl
-	key := c.cacheKey(req)
-	var expire = c.maxTTL
-	for _, answer := range resp.Answer {
-		if ttl := time.Duration(answer.Header().Ttl) * time.Second; ttl < expire {
-			expire = ttl
+	key := c.cacheKey(view, req)
+	var expire = policy.maxTTL
+	if len(resp.Answer) > 0 {
+		for _, answer := range resp.Answer {
+			if ttl := time.Duration(answer.Header().Ttl) * time.Second; ttl < expire {
+				expire = ttl
+			}
 		}
+		if expire < policy.minTTL {
+			expire = policy.minTTL
+		}
+		for i := 0; i < len(resp.Answer); i++ {
+			resp.Answer[i].Header().Ttl = uint32(expire.Seconds())
+		}
+	} else if expire = negativeTTL(resp, policy.negativeMaxTTL); expire <= 0 {
+		return
 	}
-	if expire < c.minTTL {
-		expire = c.minTTL
-	}
-	for i := 0; i < len(resp.Answer); i++ {
-		resp.Answer[i].Header().Ttl = uint32(expire.Seconds())
+	for _, rr := range resp.Ns {
+		if hdr := rr.Header(); time.Duration(hdr.Ttl)*time.Second > expire {
+			hdr.Ttl = uint32(expire.Seconds())
+		}
 	}
 	// set cache
-	expiredAt := time.Now().Add(expire).Unix()
-	c.lock.Lock()
-	c.items[key] = cacheItem{resp: resp, expiredAt: expiredAt}
-	c.lock.Unlock()
+	item := &cacheItem{
+		view: view, group: group, question: req.Question[0], resp: resp,
+		expiredAt: time.Now().Add(expire).Unix(), ttl: int64(expire.Seconds()),
+		size: itemSize(key, resp),
+	}
+	item.deadline = item.expiredAt + c.staleTTL
+	shard := c.shard(key)
+	shard.lock.Lock()
+	shard.insert(key, item)
+	shard.lock.Unlock()
+}
+
+// items 返回删除时间晚于now的所有缓存项
+func (c *dnsCache) items(now int64) map[string]*cacheItem {
+	items := map[string]*cacheItem{}
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for key, item := range shard.items {
+			if now < item.deadline {
+				items[key] = item
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return items
+}
+
+func (c *dnsCache) Migrate(src IDNSCache, keep func(view, group string, question dns.Question) bool) int {
+	old, ok := src.(*dnsCache)
+	if !ok || old == c || c.maxSize <= 0 {
+		return 0
+	}
+	now := time.Now().Unix()
+	count := 0
+	for key, item := range old.items(now) {
+		if now >= item.expiredAt+c.staleTTL {
+			continue
+		}
+		if keep != nil && !keep(item.view, item.group, item.question) {
+			continue
+		}
+		// 缓存项的响应不会被修改，可与旧缓存共用
+		shard := c.shard(key)
+		shard.lock.Lock()
+		shard.insert(key, &cacheItem{
+			view: item.view, group: item.group, question: item.question, resp: item.resp,
+			expiredAt: item.expiredAt, deadline: item.expiredAt + c.staleTTL, ttl: item.ttl, size: item.size,
+		})
+		shard.lock.Unlock()
+		count++
+	}
+	return count
+}
+
+// ttlPolicy 返回分组的缓存策略，分组未单独配置时使用全局配置
+func (c *dnsCache) ttlPolicy(group string) ttlPolicy {
+	if policy, exists := c.groupPolicies[group]; exists {
+		return policy
+	}
+	return ttlPolicy{minTTL: c.minTTL, maxTTL: c.maxTTL, negativeMaxTTL: c.negativeMaxTTL}
+}
+
+// negativeTTL 按RFC 2308计算否定响应（NXDOMAIN/NODATA）的缓存有效期：
+// 取authority中SOA记录的ttl与MINIMUM字段的较小值，并限制不超过maxTTL。不可缓存时返回0
+func negativeTTL(resp *dns.Msg, maxTTL time.Duration) time.Duration {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if expire := time.Duration(ttl) * time.Second; expire < maxTTL {
+			return expire
+		}
+		return maxTTL
+	}
+	return 0 // 没有SOA记录的否定响应不缓存
+}
+
+// itemOverhead 估算的每个缓存项除key及响应报文外的固定开销（map、链表节点等）
+const itemOverhead = 128
+
+// itemSize 按key及响应报文长度估算缓存项的内存占用
+func itemSize(key string, resp *dns.Msg) int {
+	return len(key) + resp.Len() + itemOverhead
 }
 
 func (c *dnsCache) Start(_cleanTick ...time.Duration) {
 	c.stopCh = make(chan struct{})
 	c.stopped = make(chan struct{})
 	go func() {
-		cleanTick := time.Minute
+		cleanTick := time.Second
 		if len(_cleanTick) > 0 {
 			cleanTick = _cleanTick[0]
 		}
 		tk := time.NewTicker(cleanTick)
+		var persistCh <-chan time.Time
+		if c.persistFile != "" && c.persistInterval > 0 {
+			persistTk := time.NewTicker(c.persistInterval)
+			defer persistTk.Stop()
+			persistCh = persistTk.C
+		}
 		for {
 			select {
+			case <-persistCh:
+				c.snapshot()
 			case <-tk.C:
-				// clean expired key
-				c.lock.Lock()
-				for key, item := range c.items {
-					if time.Now().Unix() >= item.expiredAt {
-						delete(c.items, key)
-					}
+				// clean expired key, lock shards one by one
+				now := time.Now().Unix()
+				for _, shard := range c.shards {
+					shard.expire(now)
 				}
-				c.lock.Unlock()
 			case <-c.stopCh:
 				tk.Stop()
 				close(c.stopped)
@@ -187,4 +492,29 @@ func (c *dnsCache) Start(_cleanTick ...time.Duration) {
 func (c *dnsCache) Stop() {
 	close(c.stopCh)
 	<-c.stopped
+	if c.persistFile != "" {
+		c.snapshot()
+	}
+}
+
+// LoadSnapshot 读取快照文件。重载配置时不应调用，否则迁移时被过滤或已清空的缓存会重新出现
+func (c *dnsCache) LoadSnapshot() {
+	if c.persistFile == "" {
+		return
+	}
+	if count, err := c.load(c.persistFile); err != nil {
+		logrus.Warnf("load cache snapshot from %s failed: %+v", c.persistFile, err)
+	} else {
+		logrus.Infof("load %d cache items from %s", count, c.persistFile)
+	}
+}
+
+// snapshot 将缓存写入快照文件
+func (c *dnsCache) snapshot() {
+	count, err := c.save(c.persistFile)
+	if err != nil {
+		logrus.Warnf("save cache snapshot to %s failed: %+v", c.persistFile, err)
+		return
+	}
+	logrus.Debugf("save %d cache items to %s", count, c.persistFile)
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/wolf-joe/ts-dns/config"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -21,8 +22,8 @@ func TestNewDNSCache(t *testing.T) {
 	resp.Answer = append(resp.Answer, rr)
 	rr, _ = dns.NewRR("z.cn. 0 IN A 1.1.1.2")
 	resp.Answer = append(resp.Answer, rr)
-	c.Set(req, resp)
-	assert.Nil(t, c.Get(req))
+	c.Set("", "", req, resp)
+	assert.Nil(t, c.Get("", req))
 
 	c, err = NewDNSCache(config.Conf{Cache: config.CacheConf{
 		Size: 1024, MinTTL: 1, MaxTTL: 3600,
@@ -31,20 +32,25 @@ func TestNewDNSCache(t *testing.T) {
 
 	c.Start(time.Second)
 	defer c.Stop()
-	c.Set(req, resp)
-	assert.NotNil(t, c.Get(req))
-	t.Log(c.Get(req))
+	c.Set("", "", req, resp)
+	assert.NotNil(t, c.Get("", req))
+	t.Log(c.Get("", req))
 	// expired by clean goroutine
 	time.Sleep(time.Second * 2)
-	assert.Nil(t, c.Get(req))
+	assert.Nil(t, c.Get("", req))
+
+	// isolated by view
+	c.Set("kids", "", req, resp)
+	assert.NotNil(t, c.Get("kids", req))
+	assert.Nil(t, c.Get("work", req))
 
 	c.Stop()
 	c.Start(time.Minute)
 	// expired by get
-	c.Set(req, resp)
-	assert.NotNil(t, c.Get(req))
+	c.Set("", "", req, resp)
+	assert.NotNil(t, c.Get("", req))
 	time.Sleep(time.Second * 2)
-	assert.Nil(t, c.Get(req))
+	assert.Nil(t, c.Get("", req))
 }
 
 func BenchmarkNewDNSCache(b *testing.B) {
@@ -62,7 +68,170 @@ func BenchmarkNewDNSCache(b *testing.B) {
 	resp.Answer = append(resp.Answer, rr)
 
 	for i := 0; i < b.N; i++ {
-		c.Set(req, resp)
-		assert.NotNil(b, c.Get(req))
+		c.Set("", "", req, resp)
+		assert.NotNil(b, c.Get("", req))
+	}
+}
+
+func TestDNSCache_GetStale(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	resp := new(dns.Msg)
+	rr, _ := dns.NewRR("z.cn. 0 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+
+	_, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 1, StaleTTL: -1}})
+	assert.NotNil(t, err)
+
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{
+		Size: 1, MinTTL: 1, MaxTTL: 1, StaleTTL: 60, StaleAnswerTTL: 5,
+	}})
+	assert.Nil(t, err)
+	c.Start(time.Second)
+	defer c.Stop()
+	c.Set("", "", req, resp)
+	assert.NotNil(t, c.Get("", req))
+	assert.Nil(t, c.GetStale("", req))
+
+	// expired but kept for serve-stale
+	time.Sleep(time.Second * 2)
+	assert.Nil(t, c.Get("", req))
+	stale := c.GetStale("", req)
+	assert.NotNil(t, stale)
+	assert.Equal(t, uint32(5), stale.Answer[0].Header().Ttl)
+
+	// refresh stale item
+	c.Set("", "", req, resp.Copy())
+	assert.NotNil(t, c.Get("", req))
+}
+
+func TestDNSCache_Prefetch(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	resp := new(dns.Msg)
+	rr, _ := dns.NewRR("z.cn. 0 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+
+	_, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 1, PrefetchHits: -1}})
+	assert.NotNil(t, err)
+
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{
+		Size: 1, MinTTL: 5, MaxTTL: 5, PrefetchHits: 2, PrefetchWindow: 10,
+	}})
+	assert.Nil(t, err)
+	called := make(chan string, 10)
+	c.SetPrefetchFunc(func(view string, req *dns.Msg) {
+		called <- view + "/" + req.Question[0].Name
+	})
+	c.Set("kids", "", req, resp)
+	assert.NotNil(t, c.Get("kids", req))
+	assert.Equal(t, 0, len(called))
+	// hits reached, only prefetch once
+	assert.NotNil(t, c.Get("kids", req))
+	assert.NotNil(t, c.Get("kids", req))
+	select {
+	case val := <-called:
+		assert.Equal(t, "kids/z.cn.", val)
+	case <-time.After(time.Second):
+		t.Fatal("prefetch not triggered")
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(called))
+}
+
+func TestDNSCache_Negative(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("none.z.cn.", dns.TypeAAAA)
+	soa, _ := dns.NewRR("z.cn. 300 IN SOA ns.z.cn. admin.z.cn. 1 7200 3600 1209600 10")
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 10, NegativeMaxTTL: 5}})
+	assert.Nil(t, err)
+
+	// no soa or server failure, not cached
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	c.Set("", "", req, resp)
+	assert.Nil(t, c.Get("", req))
+	resp = new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	resp.Ns = []dns.RR{dns.Copy(soa)}
+	c.Set("", "", req, resp)
+	assert.Nil(t, c.Get("", req))
+
+	// nxdomain, ttl clamped by negative_max_ttl
+	resp = new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	resp.Ns = []dns.RR{dns.Copy(soa)}
+	c.Set("", "", req, resp)
+	cached := c.Get("", req)
+	assert.NotNil(t, cached)
+	assert.Equal(t, dns.RcodeNameError, cached.Rcode)
+	assert.Equal(t, uint32(5), cached.Ns[0].Header().Ttl)
+	// ttl of authority section decremented
+	time.Sleep(time.Second * 2)
+	cached = c.Get("", req)
+	assert.NotNil(t, cached)
+	assert.True(t, cached.Ns[0].Header().Ttl <= 4)
+
+	// nodata, ttl from soa minimum
+	c, err = NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 10}})
+	assert.Nil(t, err)
+	resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Ns = []dns.RR{dns.Copy(soa)}
+	c.Set("", "", req, resp)
+	cached = c.Get("", req)
+	assert.NotNil(t, cached)
+	assert.Equal(t, dns.RcodeSuccess, cached.Rcode)
+	assert.Equal(t, 0, len(cached.Answer))
+	assert.Equal(t, uint32(10), cached.Ns[0].Header().Ttl)
+}
+
+func TestDNSCache_GroupPolicy(t *testing.T) {
+	_, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 10}, Groups: map[string]config.Group{
+		"bad": {CacheMinTTL: 100, CacheMaxTTL: 10},
+	}})
+	assert.NotNil(t, err)
+
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 10, MinTTL: 60, MaxTTL: 600}, Groups: map[string]config.Group{
+		"clean": {CacheMinTTL: 3600, CacheMaxTTL: 7200},
+		"dirty": {CacheMaxTTL: 30},
+		"work":  {DisableCache: true},
+		"other": {},
+	}})
+	assert.Nil(t, err)
+	build := func(name string, ttl int) (*dns.Msg, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " " + strconv.Itoa(ttl) + " IN A 1.1.1.1")
+		return req, &dns.Msg{Answer: []dns.RR{rr}}
+	}
+	ttlOf := func(req *dns.Msg) uint32 {
+		resp := c.Get("", req)
+		assert.NotNil(t, resp)
+		return resp.Answer[0].Header().Ttl
 	}
+
+	req, resp := build("a.cn.", 10)
+	c.Set("", "clean", req, resp)
+	assert.True(t, ttlOf(req) > 3500)
+	req, resp = build("b.cn.", 300)
+	c.Set("", "dirty", req, resp)
+	assert.True(t, ttlOf(req) <= 30)
+	req, resp = build("c.cn.", 300)
+	c.Set("", "work", req, resp)
+	assert.Nil(t, c.Get("", req))
+	req, resp = build("d.cn.", 10)
+	c.Set("", "other", req, resp)
+	assert.True(t, ttlOf(req) > 50 && ttlOf(req) <= 60)
+
+	// negative response limited by group max ttl
+	req = new(dns.Msg)
+	req.SetQuestion("none.b.cn.", dns.TypeAAAA)
+	soa, _ := dns.NewRR("b.cn. 300 IN SOA ns.b.cn. admin.b.cn. 1 7200 3600 1209600 300")
+	c.Set("", "dirty", req, &dns.Msg{Ns: []dns.RR{soa}})
+	assert.True(t, c.Get("", req).Ns[0].Header().Ttl <= 30)
+
+	// source group remembered
+	item := c.(*dnsCache).shards[0].items[c.(*dnsCache).cacheKey("", req)]
+	assert.Equal(t, "dirty", item.group)
 }
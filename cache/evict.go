@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+const (
+	EvictionLRU = "lru" // EvictionLRU 淘汰最久未访问的缓存
+	EvictionLFU = "lfu" // EvictionLFU 淘汰访问次数最少的缓存，次数相同时淘汰最久未访问的
+)
+
+// evictPolicy 缓存淘汰策略，所有操作均为O(1)，调用方需持有锁
+type evictPolicy interface {
+	// add 记录新增的key
+	add(key string)
+	// touch 记录一次访问
+	touch(key string)
+	// remove 移除key
+	remove(key string)
+	// victim 返回应被淘汰的key
+	victim() (key string, ok bool)
+}
+
+func newEvictPolicy(name string) (evictPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", EvictionLRU:
+		return newLRUPolicy(), nil
+	case EvictionLFU:
+		return newLFUPolicy(), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy: %q", name)
+}
+
+// region lru
+
+// lruPolicy 双向链表+哈希表实现的LRU，链表头部为最近访问的key
+type lruPolicy struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), elements: map[string]*list.Element{}}
+}
+
+func (p *lruPolicy) add(key string) {
+	if elem, exists := p.elements[key]; exists {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) touch(key string) {
+	if elem, exists := p.elements[key]; exists {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) remove(key string) {
+	if elem, exists := p.elements[key]; exists {
+		p.order.Remove(elem)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) victim() (string, bool) {
+	if elem := p.order.Back(); elem != nil {
+		return elem.Value.(string), true
+	}
+	return "", false
+}
+
+// endregion
+
+// region lfu
+
+// lfuPolicy 按访问次数分桶的LFU：频次链表按次数递增排列，每个频次节点内按LRU排列key
+type lfuPolicy struct {
+	freqs   *list.List // element value: *lfuFreq
+	entries map[string]*lfuEntry
+}
+
+type lfuFreq struct {
+	count uint64
+	keys  *list.List // 头部为最近访问的key
+}
+
+type lfuEntry struct {
+	freq *list.Element // value: *lfuFreq
+	elem *list.Element // element of freq.keys
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{freqs: list.New(), entries: map[string]*lfuEntry{}}
+}
+
+func (p *lfuPolicy) add(key string) {
+	if _, exists := p.entries[key]; exists {
+		p.touch(key)
+		return
+	}
+	front := p.freqs.Front()
+	if front == nil || front.Value.(*lfuFreq).count != 1 {
+		front = p.freqs.PushFront(&lfuFreq{count: 1, keys: list.New()})
+	}
+	p.entries[key] = &lfuEntry{freq: front, elem: front.Value.(*lfuFreq).keys.PushFront(key)}
+}
+
+func (p *lfuPolicy) touch(key string) {
+	entry, exists := p.entries[key]
+	if !exists {
+		return
+	}
+	cur := entry.freq.Value.(*lfuFreq)
+	next := entry.freq.Next()
+	if next == nil || next.Value.(*lfuFreq).count != cur.count+1 {
+		next = p.freqs.InsertAfter(&lfuFreq{count: cur.count + 1, keys: list.New()}, entry.freq)
+	}
+	cur.keys.Remove(entry.elem)
+	if cur.keys.Len() == 0 {
+		p.freqs.Remove(entry.freq)
+	}
+	entry.freq, entry.elem = next, next.Value.(*lfuFreq).keys.PushFront(key)
+}
+
+func (p *lfuPolicy) remove(key string) {
+	entry, exists := p.entries[key]
+	if !exists {
+		return
+	}
+	freq := entry.freq.Value.(*lfuFreq)
+	freq.keys.Remove(entry.elem)
+	if freq.keys.Len() == 0 {
+		p.freqs.Remove(entry.freq)
+	}
+	delete(p.entries, key)
+}
+
+func (p *lfuPolicy) victim() (string, bool) {
+	front := p.freqs.Front()
+	if front == nil {
+		return "", false
+	}
+	return front.Value.(*lfuFreq).keys.Back().Value.(string), true
+}
+
+// endregion
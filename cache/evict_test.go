@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"testing"
+)
+
+func TestLRUPolicy(t *testing.T) {
+	p := newLRUPolicy()
+	_, ok := p.victim()
+	assert.False(t, ok)
+	p.add("a")
+	p.add("b")
+	p.add("c")
+	p.touch("a")
+	key, _ := p.victim()
+	assert.Equal(t, "b", key)
+	p.remove("b")
+	key, _ = p.victim()
+	assert.Equal(t, "c", key)
+	p.remove("c")
+	p.remove("a")
+	_, ok = p.victim()
+	assert.False(t, ok)
+}
+
+func TestLFUPolicy(t *testing.T) {
+	p := newLFUPolicy()
+	_, ok := p.victim()
+	assert.False(t, ok)
+	p.add("a")
+	p.add("b")
+	p.add("c")
+	p.touch("a")
+	p.touch("a")
+	p.touch("b")
+	key, _ := p.victim()
+	assert.Equal(t, "c", key)
+	p.remove("c")
+	key, _ = p.victim()
+	assert.Equal(t, "b", key)
+	// same frequency, evict least recently used
+	p.add("d")
+	p.touch("d")
+	key, _ = p.victim()
+	assert.Equal(t, "b", key)
+	p.touch("b")
+	key, _ = p.victim()
+	assert.Equal(t, "d", key)
+	p.remove("a")
+	p.remove("b")
+	p.remove("d")
+	_, ok = p.victim()
+	assert.False(t, ok)
+	assert.Equal(t, 0, p.freqs.Len())
+}
+
+func TestDNSCache_Evict(t *testing.T) {
+	_, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 1, Eviction: "fifo"}})
+	assert.NotNil(t, err)
+	_, err = NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 1, MaxBytes: -1}})
+	assert.NotNil(t, err)
+
+	build := func(name string) (*dns.Msg, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp := new(dns.Msg)
+		rr, _ := dns.NewRR(name + " 60 IN A 1.1.1.1")
+		resp.Answer = append(resp.Answer, rr)
+		return req, resp
+	}
+	reqA, respA := build("a.cn.")
+	reqB, respB := build("b.cn.")
+	reqC, respC := build("c.cn.")
+
+	// lru by size
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 2}})
+	assert.Nil(t, err)
+	c.Set("", "", reqA, respA.Copy())
+	c.Set("", "", reqB, respB.Copy())
+	assert.NotNil(t, c.Get("", reqA))
+	c.Set("", "", reqC, respC.Copy())
+	assert.NotNil(t, c.Get("", reqA))
+	assert.Nil(t, c.Get("", reqB))
+	assert.NotNil(t, c.Get("", reqC))
+
+	// lfu by size
+	c, err = NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 2, Eviction: EvictionLFU}})
+	assert.Nil(t, err)
+	c.Set("", "", reqA, respA.Copy())
+	c.Set("", "", reqB, respB.Copy())
+	assert.NotNil(t, c.Get("", reqA))
+	assert.NotNil(t, c.Get("", reqA))
+	assert.NotNil(t, c.Get("", reqB))
+	c.Set("", "", reqC, respC.Copy())
+	assert.NotNil(t, c.Get("", reqA))
+	assert.Nil(t, c.Get("", reqB))
+
+	// lfu, re-set hot key keeps its frequency
+	c, err = NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 2, Eviction: EvictionLFU}})
+	assert.Nil(t, err)
+	c.Set("", "", reqA, respA.Copy())
+	c.Set("", "", reqB, respB.Copy())
+	assert.NotNil(t, c.Get("", reqA))
+	assert.NotNil(t, c.Get("", reqA))
+	assert.NotNil(t, c.Get("", reqB))
+	c.Set("", "", reqA, respA.Copy()) // refreshed after expiration/prefetch
+	c.Set("", "", reqC, respC.Copy())
+	assert.NotNil(t, c.Get("", reqA))
+	assert.Nil(t, c.Get("", reqB))
+	assert.NotNil(t, c.Get("", reqC))
+
+	// lru by bytes
+	size := itemSize(c.(*dnsCache).cacheKey("", reqA), respA)
+	c, err = NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 100, MaxBytes: size*2 + 1}})
+	assert.Nil(t, err)
+	c.Set("", "", reqA, respA.Copy())
+	c.Set("", "", reqB, respB.Copy())
+	c.Set("", "", reqC, respC.Copy())
+	assert.Nil(t, c.Get("", reqA))
+	assert.NotNil(t, c.Get("", reqB))
+	assert.NotNil(t, c.Get("", reqC))
+	assert.Equal(t, size*2, c.(*dnsCache).shards[0].bytes)
+
+	// lfu by bytes, re-set key grows and evicts itself when it is the least used
+	s, err := newShard(EvictionLFU, 10, 100, 0)
+	assert.Nil(t, err)
+	s.insert("a", &cacheItem{resp: new(dns.Msg), size: 40, deadline: 10})
+	s.insert("b", &cacheItem{resp: new(dns.Msg), size: 40, deadline: 10})
+	s.policy.touch("b")
+	s.policy.touch("b")
+	s.insert("a", &cacheItem{resp: new(dns.Msg), size: 60, deadline: 10})
+	assert.Equal(t, 2, len(s.items))
+	assert.Equal(t, 100, s.bytes)
+	assert.Equal(t, uint64(2), s.policy.(*lfuPolicy).entries["a"].freq.Value.(*lfuFreq).count)
+	s.insert("a", &cacheItem{resp: new(dns.Msg), size: 70, deadline: 10})
+	assert.Equal(t, 1, len(s.items))
+	assert.Equal(t, 70, s.bytes)
+	assert.Equal(t, uint64(1), s.evictedCnt)
+	assert.Equal(t, 1, len(s.policy.(*lfuPolicy).entries))
+	assert.Equal(t, uint64(1), s.policy.(*lfuPolicy).entries["a"].freq.Value.(*lfuFreq).count)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Entry 缓存项信息
+type Entry struct {
+	View    string   `json:"view,omitempty"`
+	Group   string   `json:"group,omitempty"` // 产生该响应的分组
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Rcode   string   `json:"rcode"`
+	TTL     int64    `json:"ttl"` // 剩余有效期，单位为秒，处于serve-stale窗口时为负数
+	Stale   bool     `json:"stale,omitempty"`
+	Hits    uint32   `json:"hits"`
+	Answers []string `json:"answers,omitempty"`
+}
+
+// Stats 缓存统计信息
+type Stats struct {
+	Size      int    `json:"size"`  // 缓存项数量
+	Bytes     int    `json:"bytes"` // 缓存项估算的内存占用
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // 因容量不足被淘汰的缓存项数量
+	Expired   uint64 `json:"expired"`   // 因过期被清理的缓存项数量
+}
+
+// matchName 判断域名是否匹配过滤条件，name为空时匹配所有域名
+func matchName(qName, name string, suffix bool) bool {
+	if name == "" {
+		return true
+	}
+	qName, name = strings.ToLower(dns.Fqdn(qName)), strings.ToLower(dns.Fqdn(name))
+	if qName == name {
+		return true
+	}
+	return suffix && (name == "." || strings.HasSuffix(qName, "."+name))
+}
+
+func (c *dnsCache) List(name string, suffix bool) []Entry {
+	now := time.Now().Unix()
+	var entries []Entry
+	for _, item := range c.items(now) {
+		if !matchName(item.question.Name, name, suffix) {
+			continue
+		}
+		entry := Entry{
+			View: item.view, Group: item.group, Name: item.question.Name,
+			Type: dns.TypeToString[item.question.Qtype], Rcode: dns.RcodeToString[item.resp.Rcode],
+			TTL: item.expiredAt - now, Stale: now >= item.expiredAt, Hits: atomic.LoadUint32(&item.hits),
+		}
+		for _, rr := range item.resp.Answer {
+			entry.Answers = append(entry.Answers, rr.String())
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+		return entries[i].View < entries[j].View
+	})
+	return entries
+}
+
+func (c *dnsCache) Delete(name string, suffix bool) int {
+	if name == "" {
+		return 0
+	}
+	count := 0
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for key, item := range shard.items {
+			if matchName(item.question.Name, name, suffix) {
+				shard.remove(key)
+				count++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return count
+}
+
+func (c *dnsCache) Flush() int {
+	count := 0
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for key := range shard.items {
+			shard.remove(key)
+			count++
+		}
+		shard.lock.Unlock()
+	}
+	return count
+}
+
+func (c *dnsCache) Stats() Stats {
+	stats := Stats{Hits: atomic.LoadUint64(&c.hitCnt), Misses: atomic.LoadUint64(&c.missCnt)}
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		stats.Size += len(shard.items)
+		stats.Bytes += shard.bytes
+		stats.Evictions += shard.evictedCnt
+		stats.Expired += shard.expiredCnt
+		shard.lock.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"testing"
+)
+
+func TestMatchName(t *testing.T) {
+	assert.True(t, matchName("a.qq.com.", "", false))
+	assert.True(t, matchName("qq.com.", "QQ.com", false))
+	assert.False(t, matchName("a.qq.com.", "qq.com", false))
+	assert.True(t, matchName("a.qq.com.", "qq.com", true))
+	assert.False(t, matchName("aqq.com.", "qq.com", true))
+	assert.True(t, matchName("a.qq.com.", ".", true))
+}
+
+func TestDNSCache_Manage(t *testing.T) {
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 2}})
+	assert.Nil(t, err)
+	set := func(view, group, name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " 60 IN A 1.1.1.1")
+		c.Set(view, group, req, &dns.Msg{Answer: []dns.RR{rr}})
+		return req
+	}
+	reqA := set("", "clean", "qq.com.")
+	set("kids", "dirty", "a.qq.com.")
+	assert.NotNil(t, c.Get("", reqA))
+	assert.Nil(t, c.Get("kids", reqA))
+
+	entries := c.List("", false)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "a.qq.com.", entries[0].Name)
+	assert.Equal(t, "kids", entries[0].View)
+	assert.Equal(t, "dirty", entries[0].Group)
+	assert.Equal(t, "qq.com.", entries[1].Name)
+	assert.Equal(t, "A", entries[1].Type)
+	assert.Equal(t, uint32(1), entries[1].Hits)
+	assert.True(t, entries[1].TTL > 0 && entries[1].TTL <= 60)
+	assert.Equal(t, 1, len(entries[1].Answers))
+	assert.Equal(t, 1, len(c.List("qq.com", false)))
+	assert.Equal(t, 2, len(c.List("qq.com", true)))
+
+	// evict by lru
+	set("", "clean", "b.cn.")
+	stats := c.Stats()
+	assert.Equal(t, Stats{Size: 2, Bytes: stats.Bytes, Hits: 1, Misses: 1, Evictions: 1}, stats)
+
+	assert.Equal(t, 0, c.Delete("", true))
+	assert.Equal(t, 1, c.Delete("qq.com", true))
+	assert.Equal(t, 1, c.Flush())
+	assert.Equal(t, 0, c.Stats().Size)
+	assert.Equal(t, 0, c.Stats().Bytes)
+}
@@ -0,0 +1,22 @@
+package cache
+
+import (
+	"github.com/wolf-joe/ts-dns/metrics"
+)
+
+// 缓存命中及清理相关的监控指标。缓存随配置重载重建，指标在进程内累计，不随重载清零
+var (
+	cacheHits      = metrics.NewCounterVec("tsdns_cache_hits_total", "DNS cache hits.")
+	cacheMisses    = metrics.NewCounterVec("tsdns_cache_misses_total", "DNS cache misses.")
+	cacheEvictions = metrics.NewCounterVec("tsdns_cache_evictions_total",
+		"Entries evicted from the DNS cache due to capacity.")
+	cacheExpired = metrics.NewCounterVec("tsdns_cache_expired_total", "Expired entries removed from the DNS cache.")
+)
+
+func init() {
+	metrics.Default.MustRegister(cacheHits, cacheMisses, cacheEvictions, cacheExpired)
+	// 无标签的计数器在首次计数前也输出0
+	for _, counter := range []*metrics.CounterVec{cacheHits, cacheMisses, cacheEvictions, cacheExpired} {
+		counter.Add(0)
+	}
+}
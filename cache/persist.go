@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// persistMagic 缓存快照文件头，格式变化时需修改版本号
+const persistMagic = "TSDNS-CACHE-2\n"
+
+// 快照文件由文件头及若干条记录组成，每条记录依次为（整数均为大端序）：
+// key、view、group、question name（uint16长度+内容），question type、question class（uint16），
+// expiredAt、ttl（int64），响应报文（uint16长度+wire format）
+
+// save 将未过期（含serve-stale窗口内）的缓存写入快照文件，先写入临时文件再重命名以免写入中断损坏快照
+func (c *dnsCache) save(path string) (int, error) {
+	items := c.items(time.Now().Unix())
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("create temp file failed: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	w := bufio.NewWriter(tmp)
+	_, _ = w.WriteString(persistMagic)
+	count := 0
+	for key, item := range items {
+		wire, err := item.resp.Pack()
+		if err != nil || len(wire) > 0xffff {
+			continue
+		}
+		writeString(w, key)
+		writeString(w, item.view)
+		writeString(w, item.group)
+		writeString(w, item.question.Name)
+		_ = binary.Write(w, binary.BigEndian, item.question.Qtype)
+		_ = binary.Write(w, binary.BigEndian, item.question.Qclass)
+		_ = binary.Write(w, binary.BigEndian, item.expiredAt)
+		_ = binary.Write(w, binary.BigEndian, item.ttl)
+		writeString(w, string(wire))
+		count++
+	}
+	if err = w.Flush(); err != nil {
+		_ = tmp.Close()
+		return 0, fmt.Errorf("write snapshot failed: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, fmt.Errorf("close snapshot failed: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("rename snapshot failed: %w", err)
+	}
+	return count, nil
+}
+
+// load 从快照文件读取缓存，跳过已过期的缓存项及当前已存在的key。快照文件不存在时不返回错误
+func (c *dnsCache) load(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer func() { _ = file.Close() }()
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(persistMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != persistMagic {
+		return 0, errors.New("invalid snapshot header")
+	}
+	now := time.Now().Unix()
+	count := 0
+	for {
+		key, err := readString(r)
+		if err == io.EOF {
+			return count, nil
+		}
+		item := &cacheItem{}
+		var wire string
+		if err == nil {
+			item.view, err = readString(r)
+		}
+		if err == nil {
+			item.group, err = readString(r)
+		}
+		if err == nil {
+			item.question.Name, err = readString(r)
+		}
+		for _, val := range []interface{}{
+			&item.question.Qtype, &item.question.Qclass, &item.expiredAt, &item.ttl,
+		} {
+			if err == nil {
+				err = binary.Read(r, binary.BigEndian, val)
+			}
+		}
+		if err == nil {
+			wire, err = readString(r)
+		}
+		if err != nil {
+			return count, fmt.Errorf("read snapshot failed: %w", err)
+		}
+		if item.deadline = item.expiredAt + c.staleTTL; now >= item.deadline {
+			continue
+		}
+		item.resp = new(dns.Msg)
+		if err = item.resp.Unpack([]byte(wire)); err != nil {
+			continue
+		}
+		item.size = itemSize(key, item.resp)
+		shard := c.shard(key)
+		shard.lock.Lock()
+		if _, exists := shard.items[key]; !exists {
+			shard.insert(key, item)
+			count++
+		}
+		shard.lock.Unlock()
+	}
+}
+
+func writeString(w *bufio.Writer, val string) {
+	_ = binary.Write(w, binary.BigEndian, uint16(len(val)))
+	_, _ = w.WriteString(val)
+}
+
+func readString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDNSCache_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+	conf := config.Conf{Cache: config.CacheConf{Size: 10, PersistFile: path}}
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("z.cn. 60 IN A 1.1.1.1")
+	expiredReq := new(dns.Msg)
+	expiredReq.SetQuestion("x.cn.", dns.TypeA)
+
+	c, err := NewDNSCache(conf)
+	assert.Nil(t, err)
+	c.Start()
+	c.Set("kids", "", req, &dns.Msg{Answer: []dns.RR{rr}})
+	c.Set("", "", expiredReq, &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+	c.(*dnsCache).shards[0].items[c.(*dnsCache).cacheKey("", expiredReq)].expiredAt = time.Now().Unix() - 1
+	c.Stop()
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	c, err = NewDNSCache(conf)
+	assert.Nil(t, err)
+	c.LoadSnapshot()
+	c.Start()
+	resp := c.Get("kids", req)
+	assert.NotNil(t, resp)
+	assert.Equal(t, "1.1.1.1", resp.Answer[0].(*dns.A).A.String())
+	assert.True(t, resp.Answer[0].Header().Ttl <= 60)
+	assert.Nil(t, c.Get("", req))
+	assert.Nil(t, c.Get("", expiredReq))
+	item := c.(*dnsCache).shards[0].items[c.(*dnsCache).cacheKey("kids", req)]
+	assert.Equal(t, "kids", item.view)
+	assert.Equal(t, req.Question[0], item.question)
+	c.Stop()
+
+	// invalid snapshot
+	assert.Nil(t, os.WriteFile(path, []byte("invalid"), 0644))
+	c, err = NewDNSCache(conf)
+	assert.Nil(t, err)
+	_, err = c.(*dnsCache).load(path)
+	assert.NotNil(t, err)
+
+	// periodic snapshot
+	conf.Cache.PersistInterval = 1
+	c, err = NewDNSCache(conf)
+	assert.Nil(t, err)
+	c.Start()
+	defer c.Stop()
+	c.Set("", "", req, &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+	time.Sleep(1500 * time.Millisecond)
+	other, _ := NewDNSCache(conf)
+	count, err := other.(*dnsCache).load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
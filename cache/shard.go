@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"sync"
+)
+
+const (
+	maxShards    = 32  // 分片数上限
+	minShardSize = 256 // 每个分片的最小容量，容量较小时减少分片数，避免淘汰策略因分片过多而失准
+)
+
+// cacheShard 缓存分片，各分片使用独立的锁、淘汰策略及容量限制
+type cacheShard struct {
+	lock     sync.Mutex
+	items    map[string]*cacheItem
+	policy   evictPolicy
+	bytes    int // 分片内缓存项估算的内存占用
+	maxSize  int
+	maxBytes int // 为0时不限制
+
+	evictedCnt uint64 // 被淘汰的缓存项数量
+	expiredCnt uint64 // 因过期被删除的缓存项数量
+
+	// 时间轮：按删除时间（秒）索引缓存key，清理时只检查到期的槽位，无需扫描所有缓存
+	wheel  map[int64]map[string]struct{}
+	cursor int64 // 不晚于该时间的槽位均已清理
+}
+
+// shardCount 根据缓存容量计算分片数
+func shardCount(size int) int {
+	n := size / minShardSize
+	if n < 1 {
+		return 1
+	}
+	if n > maxShards {
+		return maxShards
+	}
+	return n
+}
+
+func newShard(eviction string, maxSize, maxBytes int, now int64) (*cacheShard, error) {
+	policy, err := newEvictPolicy(eviction)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheShard{
+		items:    map[string]*cacheItem{},
+		policy:   policy,
+		maxSize:  maxSize,
+		maxBytes: maxBytes,
+		wheel:    map[int64]map[string]struct{}{},
+		cursor:   now,
+	}, nil
+}
+
+// insert 写入缓存项，空间不足时按淘汰策略淘汰其它缓存项，调用方需持有锁
+func (s *cacheShard) insert(key string, item *cacheItem) {
+	if s.maxBytes > 0 && item.size > s.maxBytes {
+		return
+	}
+	// 已存在时保留其在淘汰策略中的记录（如LFU的访问次数），仅替换缓存项
+	exists := s.unlink(key)
+	// evict until there is enough space
+	for len(s.items) >= s.maxSize || (s.maxBytes > 0 && s.bytes+item.size > s.maxBytes) {
+		victim, ok := s.policy.victim()
+		if !ok {
+			break
+		}
+		if victim == key {
+			s.policy.remove(key)
+			exists = false
+			continue
+		}
+		s.remove(victim)
+		s.evictedCnt++
+		cacheEvictions.Inc()
+	}
+	if item.deadline <= s.cursor {
+		item.deadline = s.cursor + 1
+	}
+	slot, ok := s.wheel[item.deadline]
+	if !ok {
+		slot = map[string]struct{}{}
+		s.wheel[item.deadline] = slot
+	}
+	slot[key] = struct{}{}
+	s.items[key] = item
+	s.bytes += item.size
+	if exists {
+		s.policy.touch(key)
+	} else {
+		s.policy.add(key)
+	}
+}
+
+// remove 删除缓存项，调用方需持有锁
+func (s *cacheShard) remove(key string) {
+	if s.unlink(key) {
+		s.policy.remove(key)
+	}
+}
+
+// unlink 删除缓存项但不修改淘汰策略，返回缓存项是否存在，调用方需持有锁
+func (s *cacheShard) unlink(key string) bool {
+	item, exists := s.items[key]
+	if !exists {
+		return false
+	}
+	delete(s.items, key)
+	s.bytes -= item.size
+	if slot, exists := s.wheel[item.deadline]; exists {
+		delete(slot, key)
+		if len(slot) == 0 {
+			delete(s.wheel, item.deadline)
+		}
+	}
+	return true
+}
+
+// expire 删除所有不晚于now到期的缓存项，返回删除的数量
+func (s *cacheShard) expire(now int64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for ; s.cursor < now; s.cursor++ {
+		for key := range s.wheel[s.cursor+1] {
+			s.remove(key)
+			count++
+		}
+	}
+	s.expiredCnt += uint64(count)
+	cacheExpired.Add(float64(count))
+	return count
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fastrand"
+	"github.com/wolf-joe/ts-dns/config"
+	"strconv"
+	"testing"
+)
+
+func TestShardCount(t *testing.T) {
+	assert.Equal(t, 1, shardCount(0))
+	assert.Equal(t, 1, shardCount(511))
+	assert.Equal(t, 4, shardCount(1024))
+	assert.Equal(t, maxShards, shardCount(1<<20))
+}
+
+func TestCacheShard_Expire(t *testing.T) {
+	s, err := newShard(EvictionLRU, 10, 0, 100)
+	assert.Nil(t, err)
+	s.insert("a", &cacheItem{resp: new(dns.Msg), deadline: 105})
+	s.insert("b", &cacheItem{resp: new(dns.Msg), deadline: 110})
+	s.insert("c", &cacheItem{resp: new(dns.Msg), deadline: 50}) // already expired
+	assert.Equal(t, int64(101), s.items["c"].deadline)
+
+	assert.Equal(t, 1, s.expire(101))
+	assert.Equal(t, 0, s.expire(104))
+	assert.Equal(t, 1, s.expire(107))
+	assert.Equal(t, []string{"b"}, func() (keys []string) {
+		for key := range s.items {
+			keys = append(keys, key)
+		}
+		return
+	}())
+	// overwrite item, old deadline removed from wheel
+	s.insert("b", &cacheItem{resp: new(dns.Msg), deadline: 120})
+	assert.Equal(t, 0, s.expire(115))
+	assert.Equal(t, 1, s.expire(120))
+	assert.Equal(t, 0, len(s.items))
+	assert.Equal(t, 0, len(s.wheel))
+	assert.Equal(t, 0, s.bytes)
+}
+
+func TestDNSCache_Shard(t *testing.T) {
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: 4096}})
+	assert.Nil(t, err)
+	dc := c.(*dnsCache)
+	assert.Equal(t, 16, len(dc.shards))
+	rr, _ := dns.NewRR("z.cn. 60 IN A 1.1.1.1")
+	for i := 0; i < 1000; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(strconv.Itoa(i)+".z.cn.", dns.TypeA)
+		c.Set("", "", req, &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+	}
+	assert.Equal(t, 1000, dc.Stats().Size)
+	for _, shard := range dc.shards {
+		assert.NotEqual(t, 0, len(shard.items))
+	}
+}
+
+// benchmarkParallel 并发读写缓存，读写比约为9:1
+func benchmarkParallel(b *testing.B, size int) {
+	c, err := NewDNSCache(config.Conf{Cache: config.CacheConf{Size: size, MinTTL: 60, MaxTTL: 3600}})
+	assert.Nil(b, err)
+	const keys = minShardSize // 保证所有key均可被缓存
+	reqs := make([]*dns.Msg, keys)
+	rr, _ := dns.NewRR("z.cn. 60 IN A 1.1.1.1")
+	for i := range reqs {
+		reqs[i] = new(dns.Msg)
+		reqs[i].SetQuestion(strconv.Itoa(i)+".z.cn.", dns.TypeA)
+		c.Set("", "", reqs[i], &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := fastrand.Uint32()
+		for pb.Next() {
+			n++
+			req := reqs[n%keys]
+			if n%10 == 0 {
+				c.Set("", "", req, &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+			} else {
+				c.Get("", req)
+			}
+		}
+	})
+}
+
+func BenchmarkDNSCache_Parallel_1Shard(b *testing.B) {
+	benchmarkParallel(b, minShardSize*2-1)
+}
+
+func BenchmarkDNSCache_Parallel_Sharded(b *testing.B) {
+	benchmarkParallel(b, minShardSize*maxShards)
+}
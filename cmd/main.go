@@ -5,13 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/admin"
 	"github.com/wolf-joe/ts-dns/config"
 	"github.com/wolf-joe/ts-dns/inbound"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 )
@@ -42,63 +41,82 @@ func main() {
 	_ = toml.NewEncoder(buf).Encode(conf)
 	logrus.Debugf("load config success: %s", buf)
 	// 解析监听地址
-	if *listen == "" {
-		listen = &conf.Listen
+	if *listen != "" {
+		conf.Listen = *listen
 	}
-	addr, network := *listen, ""
-	if parts := strings.SplitN(*listen, "/", 2); len(parts) == 2 {
-		addr, network = parts[0], strings.ToLower(parts[1])
+	listeners, err := conf.AllListeners()
+	if err != nil {
+		logrus.Fatalf("parse listeners failed: %+v", err)
 	}
-	if network != "" && network != "udp" && network != "tcp" {
-		logrus.Fatalf("unknown network: %q", network)
+	if len(listeners) == 0 {
+		logrus.Fatalf("no listener configured")
 	}
 	// 构建handler
 	handler, err := inbound.NewHandler(conf)
 	if err != nil {
 		logrus.Fatalf("build handler failed: %+v", err)
 	}
+	// 启动服务
+	servers := inbound.NewListeners(handler)
+	if err = servers.Reload(listeners); err != nil {
+		logrus.Fatalf("start listeners failed: %+v", err)
+	}
+	// 启动管理接口，修改监听地址需重启进程
+	reload := func() error { return reloadConf(*filename, *listen, handler, servers) }
+	adminSrv := admin.NewServer(handler, reload)
+	if conf.Admin.Listen != "" {
+		if err = adminSrv.Start(conf.Admin.Listen); err != nil {
+			logrus.Fatalf("start admin api failed: %+v", err)
+		}
+	}
 	// 监听SIGNUP命令
 	signCh := make(chan os.Signal, 1)
 	signal.Notify(signCh, syscall.SIGHUP)
-	go reloadConf(signCh, filename, handler)
-
-	// 启动服务
-	wg := sync.WaitGroup{}
-	runSrv := func(net string) {
-		defer wg.Done()
-		srv := &dns.Server{Addr: addr, Net: net, Handler: handler}
-		logrus.Infof("listen on %s/%s", addr, net)
-		if err = srv.ListenAndServe(); err != nil {
-			logrus.Errorf("service stopped: %+v", err)
+	go func() {
+		for range signCh {
+			if err := reload(); err != nil {
+				logrus.Warnf("reload config failed: %+v", err)
+				continue
+			}
+			logrus.Infof("reload config success")
 		}
-	}
-	if network != "" {
-		wg.Add(1)
-		go runSrv(network)
-	} else {
-		wg.Add(2)
-		go runSrv("udp")
-		go runSrv("tcp")
-	}
-	wg.Wait()
+	}()
+	// 等待退出
+	exitCh := make(chan os.Signal, 1)
+	signal.Notify(exitCh, syscall.SIGINT, syscall.SIGTERM)
+	<-exitCh
+	adminSrv.Stop()
+	servers.Stop()
+	handler.Stop()
 	logrus.Infof("ts-dns exists")
 }
 
-func reloadConf(ch chan os.Signal, filename *string, handler inbound.IHandler) {
-	for {
-		<-ch
-		conf := config.Conf{}
-		if _, err := toml.DecodeFile(*filename, &conf); err != nil {
-			logrus.Warnf("load config file %q failed: %+v", *filename, err)
-			continue
-		}
-		buf := bytes.NewBuffer(nil)
-		_ = toml.NewEncoder(buf).Encode(conf)
-		logrus.Debugf("reload config: %s", buf)
-		if err := handler.ReloadConfig(conf); err != nil {
-			logrus.Warnf("reload config failed: %+v", err)
-			continue
-		}
-		logrus.Infof("reload config success")
+// reloadLock 串行化SIGHUP及管理接口触发的重载
+var reloadLock sync.Mutex
+
+// reloadConf 重新读取配置文件，并应用至handler及监听服务
+func reloadConf(filename, listen string, handler inbound.IHandler, servers *inbound.Listeners) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	conf := config.Conf{}
+	if _, err := toml.DecodeFile(filename, &conf); err != nil {
+		return fmt.Errorf("load config file %q failed: %w", filename, err)
+	}
+	buf := bytes.NewBuffer(nil)
+	_ = toml.NewEncoder(buf).Encode(conf)
+	logrus.Debugf("reload config: %s", buf)
+	if listen != "" {
+		conf.Listen = listen
+	}
+	listeners, err := conf.AllListeners()
+	if err != nil {
+		return fmt.Errorf("parse listeners failed: %w", err)
+	}
+	if err = handler.ReloadConfig(conf); err != nil {
+		return fmt.Errorf("reload handler failed: %w", err)
+	}
+	if err = servers.Reload(listeners); err != nil {
+		return fmt.Errorf("reload listeners failed: %w", err)
 	}
+	return nil
 }
@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Conf struct {
 	HostsFiles []string          `toml:"hosts_files"`
 	Hosts      map[string]string `toml:"hosts"`
@@ -8,16 +13,213 @@ type Conf struct {
 	Groups        map[string]Group          `toml:"groups"`
 	DisableIPv6   bool                      `toml:"disable_ipv6"`
 	DisableQTypes []string                  `toml:"disable_qtypes"`
+	DisabledRcode string                    `toml:"disabled_rcode"`
+	QueryTimeout  int                       `toml:"query_timeout"` // 单个请求的处理时长上限，单位为毫秒，为0时不限制
 	Redirectors   map[string]RedirectorConf `toml:"redirectors"`
 
-	Listen string `toml:"listen"`
+	Views map[string]ViewConf `toml:"views"`
+
+	AllowClients []string      `toml:"allow_clients"`
+	DenyClients  []string      `toml:"deny_clients"`
+	DenyAction   string        `toml:"deny_action"`
+	RateLimit    RateLimitConf `toml:"rate_limit"`
+	RRL          RRLConf       `toml:"rrl"`
+
+	Listen    string         `toml:"listen"`
+	TLSCert   string         `toml:"tls_cert"`
+	TLSKey    string         `toml:"tls_key"`
+	DoHServer DoHServerConf  `toml:"doh_server"`
+	Listeners []ListenerConf `toml:"listeners"`
+
+	Admin    AdminConf    `toml:"admin"`
+	Trace    TraceConf    `toml:"trace"`
+	QueryLog QueryLogConf `toml:"query_log"`
+	Dnstap   DnstapConf   `toml:"dnstap"`
+}
+
+// AllListeners 汇总listen、doh_server及listeners配置，返回协议已确定的监听列表
+func (c Conf) AllListeners() ([]ListenerConf, error) {
+	var confs []ListenerConf
+	if c.Listen != "" {
+		lc, err := ParseListen(c.Listen)
+		if err != nil {
+			return nil, err
+		}
+		confs = append(confs, lc)
+	}
+	if c.DoHServer.Listen != "" {
+		lc := ListenerConf{
+			Addr:     c.DoHServer.Listen,
+			Protocol: ProtocolHTTPS,
+			TLSCert:  c.DoHServer.TLSCert,
+			TLSKey:   c.DoHServer.TLSKey,
+			Path:     c.DoHServer.Path,
+			TrustXFF: c.DoHServer.TrustXFF,
+		}
+		if lc.TLSCert == "" && lc.TLSKey == "" {
+			lc.Protocol = ProtocolHTTP
+		}
+		confs = append(confs, lc)
+	}
+	confs = append(confs, c.Listeners...)
+	// 补全协议及证书
+	var res []ListenerConf
+	for _, lc := range confs {
+		protocol := strings.ToLower(lc.Protocol)
+		if protocol == "tcp-tls" {
+			protocol = ProtocolTLS
+		}
+		if protocol == ProtocolTLS || protocol == ProtocolHTTPS {
+			if lc.TLSCert == "" && lc.TLSKey == "" {
+				lc.TLSCert, lc.TLSKey = c.TLSCert, c.TLSKey
+			}
+		}
+		switch protocol {
+		case "": // 同时监听udp&tcp
+			udp, tcp := lc, lc
+			udp.Protocol, tcp.Protocol = ProtocolUDP, ProtocolTCP
+			res = append(res, udp, tcp)
+		case ProtocolUDP, ProtocolTCP, ProtocolTLS, ProtocolHTTP, ProtocolHTTPS:
+			lc.Protocol = protocol
+			res = append(res, lc)
+		default:
+			return nil, fmt.Errorf("unknown protocol %q for listener %q", lc.Protocol, lc.Addr)
+		}
+	}
+	return res, nil
+}
+
+// ParseListen 解析"地址/协议"格式的监听地址，无协议后缀时同时监听udp&tcp
+func ParseListen(listen string) (ListenerConf, error) {
+	lc := ListenerConf{Addr: listen}
+	if parts := strings.SplitN(listen, "/", 2); len(parts) == 2 {
+		lc.Addr, lc.Protocol = parts[0], strings.ToLower(parts[1])
+	}
+	switch lc.Protocol {
+	case "", ProtocolUDP, ProtocolTCP, ProtocolTLS, "tcp-tls", ProtocolHTTP, ProtocolHTTPS:
+		return lc, nil
+	}
+	return lc, fmt.Errorf("unknown network: %q", lc.Protocol)
+}
+
+// 监听协议
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+)
+
+// ListenerConf 配置文件中每个listeners section对应的结构
+type ListenerConf struct {
+	Addr     string `toml:"addr"`
+	Protocol string `toml:"protocol"` // udp/tcp/tls/http/https，为空时同时监听udp&tcp
+	// tls/https协议使用，为空时使用全局tls_cert、tls_key
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+	// http/https协议使用
+	Path     string `toml:"path"`
+	TrustXFF bool   `toml:"trust_xff"`
+}
+
+// DoHServerConf 配置文件中doh_server section对应的结构
+type DoHServerConf struct {
+	Listen   string `toml:"listen"`
+	Path     string `toml:"path"`
+	TLSCert  string `toml:"tls_cert"`
+	TLSKey   string `toml:"tls_key"`
+	TrustXFF bool   `toml:"trust_xff"`
+}
+
+// AdminConf 管理接口配置
+type AdminConf struct {
+	Listen string `toml:"listen"` // http监听地址，为空时不启用管理接口
+	Token  string `toml:"token"`  // 不为空时请求需携带"Authorization: Bearer <token>"头
+}
+
+// TraceConf 请求时间线配置
+type TraceConf struct {
+	Enable        bool `toml:"enable"`         // 记录每个请求的处理时间线
+	SlowThreshold int  `toml:"slow_threshold"` // 仅保留耗时不低于该值的请求，单位为毫秒，为0时保留所有请求
+	Capacity      int  `toml:"capacity"`       // 保留的请求数，为0时使用默认值
+}
+
+// QueryLogConf 查询日志配置
+type QueryLogConf struct {
+	File           string  `toml:"file"`            // 日志文件路径，为空时不记录
+	MaxSize        int     `toml:"max_size"`        // 单个文件的大小上限，单位为MB，超过时轮转，为0时不按大小轮转
+	RotateInterval int     `toml:"rotate_interval"` // 轮转间隔，单位为秒，为0时不按时间轮转
+	MaxBackups     int     `toml:"max_backups"`     // 保留的轮转文件数，为0时全部保留
+	Compress       bool    `toml:"compress"`        // 使用gzip压缩轮转后的文件
+	SampleRate     float64 `toml:"sample_rate"`     // 记录的查询比例，取值范围(0, 1]，为0时记录所有查询
+	OnlyFailed     bool    `toml:"only_failed"`     // 只记录被拦截（拒绝、限速、屏蔽）及失败的查询
+}
+
+// DnstapConf dnstap输出配置，socket与file只能设置一个
+type DnstapConf struct {
+	Socket   string `toml:"socket"`   // unix socket路径
+	File     string `toml:"file"`     // 文件路径，启动时清空已有内容
+	Identity string `toml:"identity"` // 服务器标识，为空时使用主机名
+}
+
+// ViewConf 配置文件中每个views section对应的结构，按客户端地址选择解析策略
+type ViewConf struct {
+	Clients  []string `toml:"clients"`  // 客户端CIDR/IP列表，多个视图匹配时使用掩码最长的视图
+	Groups   []string `toml:"groups"`   // 参与匹配的分组，靠前的分组优先匹配，为空时使用全局匹配顺序
+	Fallback string   `toml:"fallback"` // 兜底分组，为空时使用全局兜底分组
+	// 设置任一项时替代全局hosts
+	HostsFiles []string          `toml:"hosts_files"`
+	Hosts      map[string]string `toml:"hosts"`
+	// 设置任一项时替代全局配置
+	DisableIPv6   bool     `toml:"disable_ipv6"`
+	DisableQTypes []string `toml:"disable_qtypes"`
+	// qps为0时沿用全局配置，为负数时该视图不限速
+	RateLimit RateLimitConf `toml:"rate_limit"`
+}
+
+// RateLimitConf 配置文件中rate_limit section对应的结构，按客户端网段进行令牌桶限速
+type RateLimitConf struct {
+	QPS        float64 `toml:"qps"`         // 每个网段每秒允许的查询数，非正数时不限速
+	Burst      int     `toml:"burst"`       // 令牌桶容量，默认为qps向上取整
+	IPv4Prefix int     `toml:"ipv4_prefix"` // 按该前缀长度聚合IPv4客户端，默认为32
+	IPv6Prefix int     `toml:"ipv6_prefix"` // 按该前缀长度聚合IPv6客户端，默认为64
+	Action     string  `toml:"action"`      // 超出限制时的行为：refuse（默认）、drop
+}
+
+// RRLConf 配置文件中rrl section对应的结构，BIND风格的UDP响应限速
+type RRLConf struct {
+	ResponsesPerSecond int  `toml:"responses_per_second"` // 每个网段对同一响应每秒的响应数，非正数时不启用
+	NXDomainsPerSecond int  `toml:"nxdomains_per_second"` // NXDOMAIN/NODATA响应的速率，默认同responses_per_second
+	ErrorsPerSecond    int  `toml:"errors_per_second"`    // 错误响应的速率，默认同responses_per_second
+	Window             int  `toml:"window"`               // 统计窗口，单位为秒，默认为15
+	Slip               *int `toml:"slip"`                 // 每slip个超限响应中发送一个TC=1的截断响应，为0时全部丢弃，默认为2
+	IPv4Prefix         int  `toml:"ipv4_prefix"`          // 按该前缀长度聚合IPv4客户端，默认为24
+	IPv6Prefix         int  `toml:"ipv6_prefix"`          // 按该前缀长度聚合IPv6客户端，默认为56
+	LogOnly            bool `toml:"log_only"`             // 仅记录日志，不实际丢弃/截断响应
 }
 
 // CacheConf 配置文件中cache section对应的结构
 type CacheConf struct {
-	Size   int `toml:"size"`
-	MinTTL int `toml:"min_ttl"`
-	MaxTTL int `toml:"max_ttl"`
+	Size     int    `toml:"size"`
+	MaxBytes int    `toml:"max_bytes"` // 缓存占用的内存上限（估算值），为0时不限制
+	Eviction string `toml:"eviction"`  // 缓存满时的淘汰策略：lru（默认）、lfu
+	MinTTL   int    `toml:"min_ttl"`
+	MaxTTL   int    `toml:"max_ttl"`
+	// 否定响应（NXDOMAIN/NODATA）缓存的最大有效期，单位为秒
+	NegativeMaxTTL int `toml:"negative_max_ttl"`
+	// serve-stale（RFC 8767）
+	StaleTTL           int `toml:"stale_ttl"`            // 过期缓存的保留时长，单位为秒，为0时禁用
+	StaleAnswerTTL     int `toml:"stale_answer_ttl"`     // 过期响应的ttl，单位为秒
+	StaleClientTimeout int `toml:"stale_client_timeout"` // 上游超过该时长未响应时返回过期响应，单位为毫秒
+	// 重新加载配置时仅清除路由分组发生变化的缓存，为false时保留所有缓存
+	FlushChangedGroups bool `toml:"flush_changed_groups"`
+	// 持久化
+	PersistFile     string `toml:"persist_file"`     // 快照文件路径，为空时不持久化
+	PersistInterval int    `toml:"persist_interval"` // 定期写入快照的间隔，单位为秒，为0时仅在退出时写入
+	// 预取
+	PrefetchHits   int `toml:"prefetch_hits"`   // 命中次数达到该值的缓存即将过期时在后台重新解析，为0时禁用
+	PrefetchWindow int `toml:"prefetch_window"` // 剩余ttl不超过该值时触发预取，单位为秒
 }
 
 // Group 配置文件中每个groups section对应的结构
@@ -33,6 +235,9 @@ type Group struct {
 	GFWListURL  string   `toml:"gfwlist_url"`
 	Fallback    bool     `toml:"fallback"`
 
+	Priority        int `toml:"priority"`         // rules/rules_file的匹配优先级，值越大越优先
+	GFWListPriority int `toml:"gfwlist_priority"` // gfwlist的匹配优先级，同优先级时rules优先于gfwlist
+
 	Socks5 string   `toml:"socks5"`
 	DNS    []string `toml:"dns"`
 	DoT    []string `toml:"dot"`
@@ -46,6 +251,10 @@ type Group struct {
 	IPSet6   string `toml:"ipset6"`
 	IPSetTTL int    `toml:"ipset_ttl"`
 
+	CacheMinTTL  int  `toml:"cache_min_ttl"` // 覆盖全局的缓存最小ttl，单位为秒
+	CacheMaxTTL  int  `toml:"cache_max_ttl"` // 覆盖全局的缓存最大ttl，单位为秒，同时限制否定响应的缓存时长
+	DisableCache bool `toml:"disable_cache"` // 不缓存该组的响应
+
 	Redirector string `toml:"redirector"`
 }
 
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConf_AllListeners(t *testing.T) {
+	conf := Conf{
+		Listen:  ":53",
+		TLSCert: "global.crt",
+		TLSKey:  "global.key",
+		DoHServer: DoHServerConf{
+			Listen: ":80",
+			Path:   "/q",
+		},
+		Listeners: []ListenerConf{
+			{Addr: "127.0.0.1:5353", Protocol: "UDP"},
+			{Addr: ":853", Protocol: "tcp-tls"},
+			{Addr: ":443", Protocol: "https", TLSCert: "a.crt", TLSKey: "a.key"},
+		},
+	}
+	listeners, err := conf.AllListeners()
+	assert.Nil(t, err)
+	assert.Equal(t, []ListenerConf{
+		{Addr: ":53", Protocol: ProtocolUDP},
+		{Addr: ":53", Protocol: ProtocolTCP},
+		{Addr: ":80", Protocol: ProtocolHTTP, Path: "/q"},
+		{Addr: "127.0.0.1:5353", Protocol: ProtocolUDP},
+		{Addr: ":853", Protocol: ProtocolTLS, TLSCert: "global.crt", TLSKey: "global.key"},
+		{Addr: ":443", Protocol: ProtocolHTTPS, TLSCert: "a.crt", TLSKey: "a.key"},
+	}, listeners)
+
+	_, err = Conf{Listen: ":53/quic"}.AllListeners()
+	assert.NotNil(t, err)
+	_, err = Conf{Listeners: []ListenerConf{{Addr: ":53", Protocol: "quic"}}}.AllListeners()
+	assert.NotNil(t, err)
+}
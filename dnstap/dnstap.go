@@ -0,0 +1,213 @@
+package dnstap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+const (
+	queueSize         = 4096 // 待写入消息的队列长度，队列满时丢弃消息
+	flushInterval     = time.Second
+	reconnectInterval = 5 * time.Second
+	handshakeTimeout  = 3 * time.Second
+	version           = "ts-dns"
+)
+
+// Writer 在后台将dnstap消息以Frame Streams格式写入文件或unix socket。
+// 写入socket失败时丢弃消息并定期重连
+type Writer struct {
+	identity []byte
+	version  []byte
+	file     string
+	socket   string
+	queue    chan []byte
+	dropped  uint64
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+	stopped   chan struct{}
+
+	// 以下字段仅由后台goroutine访问
+	conn     net.Conn // 写入socket时不为nil
+	closer   io.Closer
+	out      *bufio.Writer
+	lastDial time.Time
+}
+
+// NewWriter 根据配置创建dnstap输出，未配置socket及file时返回nil
+func NewWriter(conf config.DnstapConf) (*Writer, error) {
+	if conf.Socket == "" && conf.File == "" {
+		return nil, nil
+	}
+	if conf.Socket != "" && conf.File != "" {
+		return nil, errors.New("only one of socket and file can be set")
+	}
+	if conf.File != "" { // 确认文件可写
+		file, err := os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		_ = file.Close()
+	}
+	identity := conf.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	return &Writer{
+		identity: []byte(identity),
+		version:  []byte(version),
+		file:     conf.File,
+		socket:   conf.Socket,
+		queue:    make(chan []byte, queueSize),
+		stopCh:   make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// Write 编码消息并放入写入队列，不会阻塞
+func (w *Writer) Write(msg *Message) {
+	select {
+	case w.queue <- msg.marshal(w.identity, w.version):
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Dropped 返回因队列已满或输出不可用而丢弃的消息数
+func (w *Writer) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Start 启动后台写入，重复调用无效
+func (w *Writer) Start() {
+	w.startOnce.Do(func() { go w.run() })
+}
+
+// Stop 写入队列中剩余的消息并关闭输出，重复调用无效
+func (w *Writer) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+		w.Start()
+		<-w.stopped
+	})
+}
+
+func (w *Writer) run() {
+	defer close(w.stopped)
+	if err := w.open(); err != nil {
+		logrus.Warnf("open dnstap output failed: %+v", err)
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame := <-w.queue:
+			w.write(frame)
+		case <-ticker.C:
+			if w.out != nil {
+				if err := w.out.Flush(); err != nil {
+					w.fail(err)
+				}
+			}
+		case <-w.stopCh:
+			for {
+				select {
+				case frame := <-w.queue:
+					w.write(frame)
+				default:
+					w.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// open 打开文件或连接socket，并完成Frame Streams握手
+func (w *Writer) open() error {
+	w.lastDial = time.Now()
+	if w.file != "" {
+		file, err := os.Create(w.file)
+		if err != nil {
+			return err
+		}
+		w.closer, w.out = file, bufio.NewWriter(file)
+		return writeControl(w.out, controlStart)
+	}
+	conn, err := net.DialTimeout("unix", w.socket, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err = writeControl(conn, controlReady); err == nil {
+		var typ uint32
+		if typ, err = readControl(conn); err == nil && typ != controlAccept {
+			err = fmt.Errorf("unexpected control frame: %d", typ)
+		}
+	}
+	if err == nil {
+		err = writeControl(conn, controlStart)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("handshake with %q failed: %w", w.socket, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	w.conn, w.closer, w.out = conn, conn, bufio.NewWriter(conn)
+	logrus.Infof("dnstap connected to %s", w.socket)
+	return nil
+}
+
+func (w *Writer) write(frame []byte) {
+	if w.out == nil && w.socket != "" && time.Since(w.lastDial) >= reconnectInterval {
+		if err := w.open(); err != nil {
+			logrus.Warnf("reconnect dnstap socket failed: %+v", err)
+		}
+	}
+	if w.out == nil {
+		atomic.AddUint64(&w.dropped, 1)
+		return
+	}
+	if err := writeData(w.out, frame); err != nil {
+		atomic.AddUint64(&w.dropped, 1)
+		w.fail(err)
+	}
+}
+
+// fail 写入失败时关闭输出，socket输出稍后重连
+func (w *Writer) fail(err error) {
+	logrus.Warnf("write dnstap failed: %+v", err)
+	_ = w.closer.Close()
+	w.conn, w.closer, w.out = nil, nil, nil
+}
+
+// close 写入STOP帧并关闭输出，socket输出需等待对端返回FINISH帧
+func (w *Writer) close() {
+	if w.out == nil {
+		return
+	}
+	err := writeControl(w.out, controlStop)
+	if err == nil {
+		err = w.out.Flush()
+	}
+	if err == nil && w.conn != nil {
+		_ = w.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		_, err = readControl(w.conn)
+	}
+	if err != nil {
+		logrus.Warnf("stop dnstap failed: %+v", err)
+	}
+	_ = w.closer.Close()
+	w.conn, w.closer, w.out = nil, nil, nil
+}
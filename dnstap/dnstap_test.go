@@ -0,0 +1,133 @@
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+// readFrames 读取Frame Streams，返回依次出现的控制帧类型及数据帧
+func readFrames(t *testing.T, r io.Reader) ([]uint32, [][]byte) {
+	var controls []uint32
+	var frames [][]byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return controls, frames
+		}
+		if size != 0 {
+			frame := make([]byte, size)
+			_, err := io.ReadFull(r, frame)
+			assert.Nil(t, err)
+			frames = append(frames, frame)
+			continue
+		}
+		assert.Nil(t, binary.Read(r, binary.BigEndian, &size))
+		payload := make([]byte, size)
+		_, err := io.ReadFull(r, payload)
+		assert.Nil(t, err)
+		controls = append(controls, binary.BigEndian.Uint32(payload))
+		if controls[len(controls)-1] == controlStop {
+			return controls, frames
+		}
+	}
+}
+
+func buildMessage(typ MessageType) *Message {
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	return &Message{Type: typ, Protocol: config.ProtocolUDP, QueryAddr: "127.0.0.1:5353",
+		QueryTime: time.Now(), Query: req}
+}
+
+func TestNewWriter(t *testing.T) {
+	w, err := NewWriter(config.DnstapConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, w)
+	dir := t.TempDir()
+	_, err = NewWriter(config.DnstapConf{Socket: filepath.Join(dir, "tap.sock"), File: filepath.Join(dir, "tap.fstrm")})
+	assert.NotNil(t, err)
+	_, err = NewWriter(config.DnstapConf{File: filepath.Join(dir, "not_exists", "tap.fstrm")})
+	assert.NotNil(t, err)
+
+	// stop without start
+	w, err = NewWriter(config.DnstapConf{File: filepath.Join(dir, "tap.fstrm")})
+	assert.Nil(t, err)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, string(w.identity))
+	w.Stop()
+	w.Stop()
+}
+
+func TestFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tap.fstrm")
+	w, err := NewWriter(config.DnstapConf{File: path, Identity: "test"})
+	assert.Nil(t, err)
+	w.Start()
+	w.Write(buildMessage(ClientQuery))
+	w.Write(buildMessage(ClientResponse))
+	w.Stop()
+	w.Write(buildMessage(ClientQuery)) // ignored after stop
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	controls, frames := readFrames(t, bytes.NewReader(content))
+	assert.Equal(t, []uint32{controlStart, controlStop}, controls)
+	assert.Equal(t, 2, len(frames))
+	_, raws := decodeFields(t, frames[1])
+	assert.Equal(t, "test", string(raws[1]))
+	nums, _ := decodeFields(t, raws[14])
+	assert.Equal(t, uint64(ClientResponse), nums[1])
+	assert.Equal(t, uint64(0), w.Dropped())
+}
+
+func TestSocketWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tap.sock")
+	// socket不可用时丢弃消息
+	w, err := NewWriter(config.DnstapConf{Socket: path})
+	assert.Nil(t, err)
+	w.Start()
+	w.Write(buildMessage(ClientQuery))
+	w.Stop()
+	assert.Equal(t, uint64(1), w.Dropped())
+
+	ln, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer func() { _ = ln.Close() }()
+	type result struct {
+		controls []uint32
+		frames   [][]byte
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		assert.Nil(t, err)
+		defer func() { _ = conn.Close() }()
+		typ, err := readControl(conn)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(controlReady), typ)
+		assert.Nil(t, writeControl(conn, controlAccept))
+		controls, frames := readFrames(t, conn)
+		assert.Nil(t, writeControl(conn, controlFinish))
+		ch <- result{controls: controls, frames: frames}
+	}()
+
+	w, err = NewWriter(config.DnstapConf{Socket: path})
+	assert.Nil(t, err)
+	w.Start()
+	w.Write(buildMessage(ForwarderQuery))
+	w.Stop()
+	res := <-ch
+	assert.Equal(t, []uint32{controlStart, controlStop}, res.controls)
+	assert.Equal(t, 1, len(res.frames))
+	assert.Equal(t, uint64(0), w.Dropped())
+}
@@ -0,0 +1,89 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame Streams协议，参考 https://farsightsec.github.io/fstrm/
+
+const contentType = "protobuf:dnstap.Dnstap"
+
+// control frame types
+const (
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+)
+
+const (
+	controlFieldContentType = 1
+	maxControlFrameSize     = 512
+)
+
+// writeControl 写入控制帧，除STOP、FINISH外均携带content type
+func writeControl(w io.Writer, typ uint32) error {
+	payload := appendUint32(nil, typ)
+	if typ != controlStop && typ != controlFinish {
+		payload = appendUint32(payload, controlFieldContentType)
+		payload = appendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+	buf := make([]byte, 0, 8+len(payload))
+	buf = appendUint32(buf, 0) // escape
+	buf = appendUint32(buf, uint32(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// readControl 读取控制帧并返回其类型，ACCEPT、READY帧需包含dnstap的content type
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if escape := binary.BigEndian.Uint32(header[:4]); escape != 0 {
+		return 0, errors.New("expect control frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > maxControlFrameSize {
+		return 0, fmt.Errorf("invalid control frame length: %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	typ := binary.BigEndian.Uint32(payload)
+	if typ != controlAccept && typ != controlReady {
+		return typ, nil
+	}
+	for fields := payload[4:]; len(fields) >= 8; {
+		field, size := binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:])
+		if uint32(len(fields)-8) < size {
+			break
+		}
+		if field == controlFieldContentType && string(fields[8:8+size]) == contentType {
+			return typ, nil
+		}
+		fields = fields[8+size:]
+	}
+	return 0, errors.New("content type not supported by peer")
+}
+
+// writeData 写入数据帧
+func writeData(w io.Writer, payload []byte) error {
+	buf := make([]byte, 0, 4+len(payload))
+	buf = appendUint32(buf, uint32(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+func appendUint32(buf []byte, val uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], val)
+	return append(buf, tmp[:]...)
+}
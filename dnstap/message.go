@@ -0,0 +1,169 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+// MessageType dnstap.Message.Type
+type MessageType uint64
+
+// 仅列出ts-dns会产生的消息类型
+const (
+	ClientQuery       MessageType = 5
+	ClientResponse    MessageType = 6
+	ForwarderQuery    MessageType = 7
+	ForwarderResponse MessageType = 8
+)
+
+// dnstap.SocketFamily
+const (
+	familyINET  = 1
+	familyINET6 = 2
+)
+
+// dnstap.SocketProtocol
+const (
+	protocolUDP = 1
+	protocolTCP = 2
+	protocolDOT = 3
+	protocolDOH = 4
+)
+
+// dnstapTypeMessage dnstap.Dnstap.Type
+const dnstapTypeMessage = 1
+
+// Message 一条dnstap消息，地址格式为ip:port
+type Message struct {
+	Type         MessageType
+	Protocol     string // config.ProtocolUDP等，"tcp-tls"视为DoT
+	QueryAddr    string // 发起查询的一方（客户端）地址，为空时不记录
+	ResponseAddr string // 响应查询的一方（ts-dns或上游）地址，为空时不记录
+	QueryTime    time.Time
+	ResponseTime time.Time // 仅响应消息需要
+	Query        *dns.Msg
+	Response     *dns.Msg
+}
+
+func socketProtocol(protocol string) uint64 {
+	switch protocol {
+	case config.ProtocolUDP:
+		return protocolUDP
+	case config.ProtocolTCP:
+		return protocolTCP
+	case config.ProtocolTLS, "tcp-tls":
+		return protocolDOT
+	case config.ProtocolHTTP, config.ProtocolHTTPS:
+		return protocolDOH
+	}
+	return 0
+}
+
+// splitAddr 将ip:port格式的地址拆分为ip及端口，无法解析时ip为nil
+func splitAddr(addr string) (net.IP, uint64) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	val, _ := strconv.ParseUint(port, 10, 16)
+	return ip, val
+}
+
+// marshal 将消息编码为protobuf格式的dnstap.Dnstap
+func (m *Message) marshal(identity, version []byte) []byte {
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(m.Type))
+	if protocol := socketProtocol(m.Protocol); protocol != 0 {
+		msg = appendVarintField(msg, 3, protocol)
+	}
+	family := uint64(0)
+	if ip, port := splitAddr(m.QueryAddr); ip != nil {
+		family = addrFamily(ip)
+		msg = appendBytesField(msg, 4, ip)
+		msg = appendVarintField(msg, 6, port)
+	}
+	if ip, port := splitAddr(m.ResponseAddr); ip != nil {
+		family = addrFamily(ip)
+		msg = appendBytesField(msg, 5, ip)
+		msg = appendVarintField(msg, 7, port)
+	}
+	if family != 0 {
+		msg = appendVarintField(msg, 2, family)
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendVarintField(msg, 8, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.Query != nil {
+		if wire, err := m.Query.Pack(); err == nil {
+			msg = appendBytesField(msg, 10, wire)
+		}
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarintField(msg, 12, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.Response != nil {
+		if wire, err := m.Response.Pack(); err == nil {
+			msg = appendBytesField(msg, 14, wire)
+		}
+	}
+
+	var buf []byte
+	if len(identity) > 0 {
+		buf = appendBytesField(buf, 1, identity)
+	}
+	if len(version) > 0 {
+		buf = appendBytesField(buf, 2, version)
+	}
+	buf = appendBytesField(buf, 14, msg)
+	buf = appendVarintField(buf, 15, dnstapTypeMessage)
+	return buf
+}
+
+func addrFamily(ip net.IP) uint64 {
+	if len(ip) == net.IPv4len {
+		return familyINET
+	}
+	return familyINET6
+}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(buf []byte, val uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], val)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarintField(buf []byte, field int, val uint64) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|wireVarint)
+	return appendVarint(buf, val)
+}
+
+func appendBytesField(buf []byte, field int, val []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|wireBytes)
+	buf = appendVarint(buf, uint64(len(val)))
+	return append(buf, val...)
+}
+
+func appendFixed32Field(buf []byte, field int, val uint32) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|wireFixed32)
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], val)
+	return append(buf, tmp[:]...)
+}
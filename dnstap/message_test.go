@@ -0,0 +1,84 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+// decodeFields 解析一层protobuf消息，varint及fixed32字段值保存在nums，bytes字段值保存在raws
+func decodeFields(t *testing.T, buf []byte) (map[int]uint64, map[int][]byte) {
+	nums, raws := map[int]uint64{}, map[int][]byte{}
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		assert.True(t, n > 0)
+		buf = buf[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			val, n := binary.Uvarint(buf)
+			assert.True(t, n > 0)
+			nums[field], buf = val, buf[n:]
+		case wireFixed32:
+			nums[field], buf = uint64(binary.LittleEndian.Uint32(buf)), buf[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			assert.True(t, n > 0)
+			buf = buf[n:]
+			raws[field], buf = buf[:size], buf[size:]
+		default:
+			t.Fatalf("unexpected wire type: %d", key&7)
+		}
+	}
+	return nums, raws
+}
+
+func TestMarshal(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	now := time.Unix(1600000000, 123456789)
+	msg := &Message{
+		Type: ForwarderResponse, Protocol: config.ProtocolTLS,
+		QueryAddr: "192.168.1.2:5353", ResponseAddr: "1.1.1.1:853",
+		QueryTime: now, ResponseTime: now.Add(time.Second), Query: req, Response: resp,
+	}
+	nums, raws := decodeFields(t, msg.marshal([]byte("host"), []byte("ts-dns")))
+	assert.Equal(t, uint64(dnstapTypeMessage), nums[15])
+	assert.Equal(t, "host", string(raws[1]))
+	assert.Equal(t, "ts-dns", string(raws[2]))
+
+	nums, raws = decodeFields(t, raws[14])
+	assert.Equal(t, uint64(ForwarderResponse), nums[1])
+	assert.Equal(t, uint64(familyINET), nums[2])
+	assert.Equal(t, uint64(protocolDOT), nums[3])
+	assert.Equal(t, net.IPv4(192, 168, 1, 2).To4(), net.IP(raws[4]))
+	assert.Equal(t, net.IPv4(1, 1, 1, 1).To4(), net.IP(raws[5]))
+	assert.Equal(t, uint64(5353), nums[6])
+	assert.Equal(t, uint64(853), nums[7])
+	assert.Equal(t, uint64(1600000000), nums[8])
+	assert.Equal(t, uint64(123456789), nums[9])
+	assert.Equal(t, uint64(1600000001), nums[12])
+	query, response := new(dns.Msg), new(dns.Msg)
+	assert.Nil(t, query.Unpack(raws[10]))
+	assert.Nil(t, response.Unpack(raws[14]))
+	assert.Equal(t, "z.cn.", query.Question[0].Name)
+	assert.True(t, response.Response)
+
+	// ipv6 and unknown address/protocol
+	msg = &Message{Type: ClientQuery, Protocol: "unknown", QueryAddr: "[::1]:53", ResponseAddr: "bad"}
+	_, raws = decodeFields(t, msg.marshal(nil, nil))
+	nums, raws = decodeFields(t, raws[14])
+	assert.Equal(t, uint64(familyINET6), nums[2])
+	_, exists := nums[3]
+	assert.False(t, exists)
+	assert.Equal(t, net.IPv6loopback, net.IP(raws[4]))
+	_, exists = raws[5]
+	assert.False(t, exists)
+}
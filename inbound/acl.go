@@ -0,0 +1,121 @@
+package inbound
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/yl2chen/cidranger"
+)
+
+const (
+	ActionRefuse = "refuse" // 响应REFUSED
+	ActionDrop   = "drop"   // 直接丢弃请求，不做响应
+)
+
+// clientACL 根据客户端地址判断是否允许查询
+type clientACL struct {
+	allow cidranger.Ranger // 为nil时允许所有客户端
+	deny  cidranger.Ranger
+	drop  bool // 拒绝时是否直接丢弃请求
+}
+
+func newClientACL(conf config.Conf) (*clientACL, error) {
+	if len(conf.AllowClients) == 0 && len(conf.DenyClients) == 0 {
+		return nil, nil
+	}
+	acl := new(clientACL)
+	var err error
+	if len(conf.AllowClients) > 0 {
+		if acl.allow, err = newRanger(conf.AllowClients); err != nil {
+			return nil, fmt.Errorf("parse allow_clients failed: %w", err)
+		}
+	}
+	if acl.deny, err = newRanger(conf.DenyClients); err != nil {
+		return nil, fmt.Errorf("parse deny_clients failed: %w", err)
+	}
+	if acl.drop, err = parseAction(conf.DenyAction); err != nil {
+		return nil, fmt.Errorf("parse deny_action failed: %w", err)
+	}
+	return acl, nil
+}
+
+// Allowed 判断客户端是否允许查询，deny_clients优先于allow_clients
+func (acl *clientACL) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return acl.allow == nil
+	}
+	if denied, _ := acl.deny.Contains(ip); denied {
+		return false
+	}
+	if acl.allow == nil {
+		return true
+	}
+	allowed, _ := acl.allow.Contains(ip)
+	return allowed
+}
+
+// parseAction 解析拒绝请求时的行为，返回是否丢弃请求
+func parseAction(action string) (drop bool, err error) {
+	switch strings.ToLower(action) {
+	case "", ActionRefuse:
+		return false, nil
+	case ActionDrop:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown action: %q", action)
+}
+
+// newRanger 根据CIDR/IP列表构建ranger，IP地址视为单个地址的网段
+func newRanger(cidrs []string) (cidranger.Ranger, error) {
+	ranger := cidranger.NewPCTrieRanger()
+	for _, val := range cidrs {
+		ipNet, err := parseCIDR(val)
+		if err != nil {
+			return nil, err
+		}
+		if err = ranger.Insert(cidranger.NewBasicRangerEntry(*ipNet)); err != nil {
+			return nil, fmt.Errorf("add cidr %q to ranger failed: %w", val, err)
+		}
+	}
+	return ranger, nil
+}
+
+func parseCIDR(val string) (*net.IPNet, error) {
+	val = strings.TrimSpace(val)
+	if !strings.Contains(val, "/") {
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return nil, fmt.Errorf("parse ip %q failed", val)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(val)
+	if err != nil {
+		return nil, fmt.Errorf("parse cidr %q failed: %w", val, err)
+	}
+	return ipNet, nil
+}
+
+// clientIP 从客户端地址中提取IP地址
+func clientIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		return v.IP
+	case *net.TCPAddr:
+		return v.IP
+	case *net.IPAddr:
+		return v.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
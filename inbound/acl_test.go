@@ -0,0 +1,141 @@
+package inbound
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/utils"
+)
+
+func TestClientACL(t *testing.T) {
+	acl, err := newClientACL(config.Conf{})
+	assert.Nil(t, err)
+	assert.Nil(t, acl)
+
+	_, err = newClientACL(config.Conf{AllowClients: []string{"1.1.1.1/33"}})
+	assert.NotNil(t, err)
+	_, err = newClientACL(config.Conf{DenyClients: []string{"abc"}})
+	assert.NotNil(t, err)
+	_, err = newClientACL(config.Conf{DenyClients: []string{"1.1.1.1"}, DenyAction: "???"})
+	assert.NotNil(t, err)
+
+	acl, err = newClientACL(config.Conf{
+		AllowClients: []string{"192.168.0.0/16", "fd00::/8"},
+		DenyClients:  []string{"192.168.1.100", "fd00::1"},
+	})
+	assert.Nil(t, err)
+	assert.False(t, acl.drop)
+	assert.True(t, acl.Allowed(net.ParseIP("192.168.1.1")))
+	assert.False(t, acl.Allowed(net.ParseIP("192.168.1.100")))
+	assert.False(t, acl.Allowed(net.ParseIP("10.0.0.1")))
+	assert.True(t, acl.Allowed(net.ParseIP("fd00::2")))
+	assert.False(t, acl.Allowed(net.ParseIP("fd00::1")))
+	assert.False(t, acl.Allowed(nil))
+
+	acl, err = newClientACL(config.Conf{DenyClients: []string{"10.0.0.0/8"}, DenyAction: "DROP"})
+	assert.Nil(t, err)
+	assert.True(t, acl.drop)
+	assert.True(t, acl.Allowed(net.ParseIP("192.168.1.1")))
+	assert.False(t, acl.Allowed(net.ParseIP("10.1.1.1")))
+	assert.True(t, acl.Allowed(nil))
+}
+
+func TestClientIP(t *testing.T) {
+	assert.Nil(t, clientIP(nil))
+	assert.Equal(t, "1.1.1.1", clientIP(&net.UDPAddr{IP: net.ParseIP("1.1.1.1")}).String())
+	assert.Equal(t, "1.1.1.1", clientIP(&net.TCPAddr{IP: net.ParseIP("1.1.1.1")}).String())
+	assert.Equal(t, "1.1.1.1", clientIP(&net.IPAddr{IP: net.ParseIP("1.1.1.1")}).String())
+	assert.Equal(t, "::1", clientIP(&net.UnixAddr{Name: "[::1]:53"}).String())
+	assert.Nil(t, clientIP(&net.UnixAddr{Name: "/tmp/dns.sock"}))
+}
+
+func TestHandlerACL(t *testing.T) {
+	conf := config.Conf{
+		Hosts:       map[string]string{"z.cn": "1.1.1.1"},
+		Groups:      map[string]config.Group{"fallback": {}},
+		DenyClients: []string{"127.0.0.0/8"},
+	}
+	h, err := newHandle(conf)
+	assert.Nil(t, err)
+	rw := utils.NewFakeRespWriter()
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.NotNil(t, rw.Msg)
+	assert.Equal(t, dns.RcodeRefused, rw.Msg.Rcode)
+	assert.Empty(t, rw.Msg.Answer)
+
+	conf.DenyAction = ActionDrop
+	h, err = newHandle(conf)
+	assert.Nil(t, err)
+	rw = utils.NewFakeRespWriter()
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.Nil(t, rw.Msg)
+
+	conf.DenyClients, conf.AllowClients = nil, []string{"127.0.0.1"}
+	h, err = newHandle(conf)
+	assert.Nil(t, err)
+	rw = utils.NewFakeRespWriter()
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.NotNil(t, rw.Msg)
+	assert.Equal(t, 1, len(rw.Msg.Answer))
+}
+
+func TestHandlerACLInternal(t *testing.T) {
+	// 模拟DoH服务器，只记录是否有连接进入
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = ln.Close() }()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+			select {
+			case accepted <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	conf := config.Conf{
+		Hosts:        map[string]string{"doh.test": "127.0.0.1"},
+		Groups:       map[string]config.Group{"fallback": {DoH: []string{"https://doh.test:" + port + "/dns-query"}}},
+		AllowClients: []string{"192.168.0.0/16"},
+		RateLimit:    config.RateLimitConf{QPS: 1, Burst: 1},
+	}
+	h, err := newHandle(conf)
+	assert.Nil(t, err)
+	h.start()
+	defer h.stop()
+
+	// 外部请求受acl限制
+	rw := utils.NewFakeRespWriter()
+	h.ServeDNS(rw, buildReq("doh.test", dns.TypeA))
+	assert.NotNil(t, rw.Msg)
+	assert.Equal(t, dns.RcodeRefused, rw.Msg.Rcode)
+	// 内部请求不受acl及限速限制
+	for i := 0; i < 3; i++ {
+		rw = utils.NewInternalRespWriter()
+		h.ServeDNS(rw, buildReq("doh.test", dns.TypeA))
+		assert.NotNil(t, rw.Msg)
+		assert.Equal(t, dns.RcodeSuccess, rw.Msg.Rcode)
+		assert.Equal(t, 1, len(rw.Msg.Answer))
+	}
+	// DoH上游的域名由handler解析，解析成功后才会连接服务器
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, _ = h.groups.Fallback().Handle(ctx, buildReq("z.cn.", dns.TypeA))
+	select {
+	case <-accepted:
+	case <-ctx.Done():
+		t.Fatal("doh upstream not resolved")
+	}
+}
@@ -0,0 +1,176 @@
+package inbound
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dohMediaType   = "application/dns-message"
+	dohDefaultPath = "/dns-query"
+	dohMaxMsgSize  = dns.MaxMsgSize
+)
+
+// NewDoHHandler 将dns.Handler包装为RFC 8484 DNS over HTTPS服务，支持GET（?dns=）和POST请求。
+// trustXFF为true时使用X-Forwarded-For中的首个地址作为客户端地址，仅在反向代理后使用
+func NewDoHHandler(handler dns.Handler, path string, trustXFF bool) http.Handler {
+	if path == "" {
+		path = dohDefaultPath
+	}
+	return &dohHandler{handler: handler, path: path, trustXFF: trustXFF}
+}
+
+type dohHandler struct {
+	handler  dns.Handler
+	path     string
+	trustXFF bool
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	req, status, err := h.readMsg(r)
+	if err != nil {
+		logrus.Debugf("read doh request from %s failed: %+v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writer := &dohRespWriter{
+		local:  addrFromString(localAddr(r)),
+		remote: addrFromString(h.clientAddr(r)),
+	}
+	h.handler.ServeDNS(writer, req)
+	if writer.msg == nil {
+		http.Error(w, "no response", http.StatusBadGateway)
+		return
+	}
+	buf, err := writer.msg.Pack()
+	if err != nil {
+		logrus.Warnf("pack doh response failed: %+v", err)
+		http.Error(w, "pack response failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	if ttl, ok := minTTL(writer.msg); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf)
+}
+
+// readMsg 从http请求中解析dns请求，失败时返回对应的http状态码
+func (h *dohHandler) readMsg(r *http.Request) (*dns.Msg, int, error) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, errors.New("missing dns param")
+		}
+		var err error
+		if buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("decode dns param failed: %w", err)
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type: %q", ct)
+		}
+		var err error
+		if buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dohMaxMsgSize)); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("read body failed: %w", err)
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("unsupported method: %s", r.Method)
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("unpack dns message failed: %w", err)
+	}
+	return req, http.StatusOK, nil
+}
+
+// clientAddr 获取客户端地址，trustXFF时优先使用X-Forwarded-For中最右侧的地址。
+// 反向代理会将客户端地址追加至末尾，左侧的地址可由客户端伪造
+func (h *dohHandler) clientAddr(r *http.Request) string {
+	if h.trustXFF {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			parts := strings.Split(values[len(values)-1], ",")
+			ip := strings.TrimSpace(parts[len(parts)-1])
+			if net.ParseIP(ip) != nil {
+				return net.JoinHostPort(ip, "0")
+			}
+		}
+	}
+	return r.RemoteAddr
+}
+
+func localAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return ""
+}
+
+func addrFromString(s string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// minTTL 获取响应中所有记录的最小ttl，用于设置http缓存时间
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if t := rr.Header().Ttl; !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// dohRespWriter 实现dns.ResponseWriter，暂存handler写入的dns响应
+type dohRespWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohRespWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohRespWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohRespWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohRespWriter) Write(buf []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(buf), nil
+}
+
+func (w *dohRespWriter) Close() error        { return nil }
+func (w *dohRespWriter) TsigStatus() error   { return nil }
+func (w *dohRespWriter) TsigTimersOnly(bool) {}
+func (w *dohRespWriter) Hijack()             {}
@@ -0,0 +1,77 @@
+package inbound
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHHandler(t *testing.T) {
+	var remote string
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		remote = w.RemoteAddr().String()
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 30 IN A 1.1.1.1")
+		resp.Answer = append(resp.Answer, rr)
+		_ = w.WriteMsg(resp)
+	})
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	req.Id = 0
+	buf, err := req.Pack()
+	assert.Nil(t, err)
+	unpack := func(rec *httptest.ResponseRecorder) *dns.Msg {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, dohMediaType, rec.Header().Get("Content-Type"))
+		assert.Equal(t, "max-age=30", rec.Header().Get("Cache-Control"))
+		msg := new(dns.Msg)
+		assert.Nil(t, msg.Unpack(rec.Body.Bytes()))
+		return msg
+	}
+
+	t.Run("get", func(t *testing.T) {
+		h := NewDoHHandler(handler, "", false)
+		param := base64.RawURLEncoding.EncodeToString(buf)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+param, nil))
+		msg := unpack(rec)
+		assert.Equal(t, 1, len(msg.Answer))
+		assert.Equal(t, "192.0.2.1:1234", remote)
+	})
+	t.Run("post", func(t *testing.T) {
+		h := NewDoHHandler(handler, "/resolve", true)
+		httpReq := httptest.NewRequest(http.MethodPost, "/resolve", bytes.NewReader(buf))
+		httpReq.Header.Set("Content-Type", dohMediaType)
+		httpReq.Header.Set("X-Forwarded-For", "10.0.0.1, 192.168.1.1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httpReq)
+		msg := unpack(rec)
+		assert.Equal(t, 1, len(msg.Answer))
+		assert.Equal(t, "192.168.1.1:0", remote) // right-most entry is appended by the trusted proxy
+	})
+	t.Run("bad_request", func(t *testing.T) {
+		h := NewDoHHandler(handler, "", false)
+		cases := []struct {
+			req  *http.Request
+			code int
+		}{
+			{httptest.NewRequest(http.MethodGet, "/other", nil), http.StatusNotFound},
+			{httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+			{httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!!", nil), http.StatusBadRequest},
+			{httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+			{httptest.NewRequest(http.MethodPost, "/dns-query", nil), http.StatusUnsupportedMediaType},
+			{httptest.NewRequest(http.MethodPut, "/dns-query", nil), http.StatusMethodNotAllowed},
+		}
+		for _, c := range cases {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, c.req)
+			assert.Equal(t, c.code, rec.Code, c.req.URL.String())
+		}
+	})
+}
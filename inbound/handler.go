@@ -1,10 +1,13 @@
 package inbound
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -13,9 +16,12 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/wolf-joe/ts-dns/cache"
 	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/dnstap"
 	"github.com/wolf-joe/ts-dns/hosts"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/querylog"
 	"github.com/wolf-joe/ts-dns/redirector"
+	"github.com/wolf-joe/ts-dns/utils"
 )
 
 // region interface
@@ -24,6 +30,14 @@ import (
 type IHandler interface {
 	dns.Handler
 	ReloadConfig(conf config.Conf) error
+	// Cache 返回当前使用的dns缓存
+	Cache() cache.IDNSCache
+	// Config 返回当前生效的配置
+	Config() config.Conf
+	// Groups 返回当前使用的所有分组
+	Groups() map[string]outbound.IGroup
+	// Traces 按从新到旧的顺序返回保留的请求时间线，未启用trace时返回nil
+	Traces() []*utils.Trace
 	Stop()
 }
 
@@ -46,24 +60,44 @@ var (
 // todo: add unittest
 type handlerWrapper struct {
 	handlerPtr unsafe.Pointer // type: *handlerImpl
+	// reloadLock 串行化ReloadConfig及Stop，避免并发重载时多个新handler同时接管旧handler的资源
+	reloadLock sync.Mutex
 }
 
 func (w *handlerWrapper) ReloadConfig(conf config.Conf) error {
+	w.reloadLock.Lock()
+	defer w.reloadLock.Unlock()
 	// create & start new handler
 	h, err := newHandle(conf)
 	if err != nil {
 		return fmt.Errorf("make new handler failed: %w", err)
 	}
+	if ptr := atomic.LoadPointer(&w.handlerPtr); ptr != nil {
+		old := (*handlerImpl)(ptr)
+		h.migrateCache(old)
+		// 配置未变化时沿用旧的时间线记录器、查询日志及dnstap输出
+		if h.traces != nil && old.traces != nil && h.conf.Trace == old.conf.Trace {
+			h.traces = old.traces
+		}
+		// 输出文件相同但配置变化时，先停止旧的输出，避免两者同时写入或轮转同一文件
+		if h.queryLog != nil && old.queryLog != nil && h.conf.QueryLog == old.conf.QueryLog {
+			h.queryLog, old.queryLogMoved = old.queryLog, true
+		} else if old.queryLog != nil && old.conf.QueryLog.File == h.conf.QueryLog.File {
+			old.queryLog.Stop()
+		}
+		if h.tap != nil && old.tap != nil && h.conf.Dnstap == old.conf.Dnstap {
+			h.tap, old.tapMoved = old.tap, true
+		} else if old.tap != nil && old.conf.Dnstap.File != "" && old.conf.Dnstap.File == h.conf.Dnstap.File {
+			old.tap.Stop()
+		}
+	} else {
+		// 仅在首次构建handler时读取缓存快照
+		h.cache.LoadSnapshot()
+	}
 	h.start()
 	// swap handler
-	for {
-		old := atomic.LoadPointer(&w.handlerPtr)
-		if atomic.CompareAndSwapPointer(&w.handlerPtr, old, unsafe.Pointer(h)) {
-			if old != nil {
-				(*handlerImpl)(old).stop()
-			}
-			break
-		}
+	if old := atomic.SwapPointer(&w.handlerPtr, unsafe.Pointer(h)); old != nil {
+		(*handlerImpl)(old).stop()
 	}
 	return nil
 }
@@ -72,16 +106,30 @@ func (w *handlerWrapper) ServeDNS(writer dns.ResponseWriter, req *dns.Msg) {
 	(*handlerImpl)(atomic.LoadPointer(&w.handlerPtr)).ServeDNS(writer, req)
 }
 
+func (w *handlerWrapper) Cache() cache.IDNSCache {
+	return (*handlerImpl)(atomic.LoadPointer(&w.handlerPtr)).cache
+}
+
+func (w *handlerWrapper) Config() config.Conf {
+	return (*handlerImpl)(atomic.LoadPointer(&w.handlerPtr)).conf
+}
+
+func (w *handlerWrapper) Groups() map[string]outbound.IGroup {
+	return (*handlerImpl)(atomic.LoadPointer(&w.handlerPtr)).groups.All()
+}
+
+func (w *handlerWrapper) Traces() []*utils.Trace {
+	if traces := (*handlerImpl)(atomic.LoadPointer(&w.handlerPtr)).traces; traces != nil {
+		return traces.list()
+	}
+	return nil
+}
+
 func (w *handlerWrapper) Stop() {
-	for {
-		old := atomic.LoadPointer(&w.handlerPtr)
-		if old == nil {
-			return
-		}
-		if atomic.CompareAndSwapPointer(&w.handlerPtr, old, nil) {
-			(*handlerImpl)(old).stop()
-			return
-		}
+	w.reloadLock.Lock()
+	defer w.reloadLock.Unlock()
+	if old := atomic.SwapPointer(&w.handlerPtr, nil); old != nil {
+		(*handlerImpl)(old).stop()
 	}
 }
 
@@ -90,26 +138,39 @@ func (w *handlerWrapper) Stop() {
 func newHandle(conf config.Conf) (*handlerImpl, error) {
 	var err error
 	h := &handlerImpl{
-		disableQTypes: map[uint16]bool{},
-		cache:         nil,
-		hosts:         nil,
-		groups:        nil,
-		redirector:    nil,
+		conf:       conf,
+		flights:    newFlightGroup(),
+		cache:      nil,
+		groups:     nil,
+		views:      nil,
+		redirector: nil,
 	}
+	defaultView := &view{}
 	// disable query types
-	if conf.DisableIPv6 {
-		h.disableQTypes[dns.TypeAAAA] = true
+	defaultView.disableQTypes, err = parseQTypes(conf.DisableIPv6, conf.DisableQTypes)
+	if err != nil {
+		return nil, err
 	}
-	for _, qTypeStr := range conf.DisableQTypes {
-		qTypeStr = strings.ToUpper(qTypeStr)
-		if _, exists := dns.StringToType[qTypeStr]; !exists {
-			return nil, fmt.Errorf("unknown query type: %q", qTypeStr)
-		}
-		h.disableQTypes[dns.StringToType[qTypeStr]] = true
+	h.disabledRcode, err = parseRcode(conf.DisabledRcode)
+	if err != nil {
+		return nil, fmt.Errorf("parse disabled_rcode failed: %w", err)
 	}
 
+	defaultView.limiter, err = newRateLimiter(conf.RateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("build rate limiter failed: %w", err)
+	}
+	h.rrl, err = newResponseLimiter(conf.RRL)
+	if err != nil {
+		return nil, fmt.Errorf("build rrl failed: %w", err)
+	}
+	// acl
+	h.acl, err = newClientACL(conf)
+	if err != nil {
+		return nil, fmt.Errorf("build acl failed: %w", err)
+	}
 	// hosts & cache
-	h.hosts, err = hosts.NewDNSHosts(conf)
+	defaultView.hosts, err = hosts.NewDNSHosts(conf)
 	if err != nil {
 		return nil, fmt.Errorf("build hosts failed: %w", err)
 	}
@@ -117,63 +178,152 @@ func newHandle(conf config.Conf) (*handlerImpl, error) {
 	if err != nil {
 		return nil, fmt.Errorf("build cache failed: %w", err)
 	}
+	h.cacheConf, h.groupConfs = conf.Cache, conf.Groups
+	h.staleTimeout = time.Duration(conf.Cache.StaleClientTimeout) * time.Millisecond
+	if conf.QueryTimeout < 0 {
+		return nil, fmt.Errorf("invalid query_timeout: %d", conf.QueryTimeout)
+	}
+	h.queryTimeout = time.Duration(conf.QueryTimeout) * time.Millisecond
+	h.traces, err = newTraceRecorder(conf.Trace)
+	if err != nil {
+		return nil, fmt.Errorf("build trace recorder failed: %w", err)
+	}
+	h.queryLog, err = querylog.NewLogger(conf.QueryLog)
+	if err != nil {
+		return nil, fmt.Errorf("build query log failed: %w", err)
+	}
+	h.tap, err = dnstap.NewWriter(conf.Dnstap)
+	if err != nil {
+		return nil, fmt.Errorf("build dnstap failed: %w", err)
+	}
 	h.groups, err = outbound.BuildGroups(conf)
 	if err != nil {
 		return nil, fmt.Errorf("build groups failed: %w", err)
 	}
-	for _, group := range h.groups {
-		if group.IsFallback() {
-			h.fallbackGroup = group
-		}
+	if h.tap != nil {
+		h.groups.OnCall(h.tapForwarder)
 	}
-	if h.fallbackGroup == nil {
+	defaultView.groups = h.groups
+	defaultView.fallbackGroup = h.groups.Fallback()
+	if defaultView.fallbackGroup == nil {
 		return nil, errors.New("fallback group not found")
 	}
-	h.redirector, err = redirector.NewRedirector(conf, h.groups)
+	h.views, err = newViewSelector(conf, defaultView, h.groups)
+	if err != nil {
+		return nil, fmt.Errorf("build views failed: %w", err)
+	}
+	h.redirector, err = redirector.NewRedirector(conf, h.groups.All())
 	if err != nil {
 		return nil, fmt.Errorf("build redirector failed: %w", err)
 	}
+	h.cache.SetPrefetchFunc(h.prefetch)
 	return h, nil
 }
 
 // region impl
 type handlerImpl struct {
-	disableQTypes map[uint16]bool
+	conf          config.Conf
+	acl           *clientACL
+	rrl           *responseLimiter
 	cache         cache.IDNSCache
-	hosts         hosts.IDNSHosts
-	groups        map[string]outbound.IGroup
-	fallbackGroup outbound.IGroup
+	cacheConf     config.CacheConf
+	groupConfs    map[string]config.Group
+	flights       *flightGroup
+	groups        *outbound.Groups
+	views         *viewSelector
 	redirector    redirector.Redirector
+	disabledRcode int
+	staleTimeout  time.Duration // 存在过期缓存时等待上游响应的时长，为0时一直等待
+	queryTimeout  time.Duration // 单个请求的处理时长上限，为0时不限制
+	traces        *traceRecorder
+	queryLog      *querylog.Logger
+	queryLogMoved bool // 查询日志已交由新handler使用，停止时不关闭
+	tap           *dnstap.Writer
+	tapMoved      bool
+}
+
+// withDeadline 为一次解析创建ctx，设置了query_timeout时附带deadline
+func (h *handlerImpl) withDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	if h.queryTimeout > 0 {
+		return context.WithTimeout(parent, h.queryTimeout)
+	}
+	return context.WithCancel(parent)
 }
 
 func (h *handlerImpl) ServeDNS(writer dns.ResponseWriter, req *dns.Msg) {
-	resp := h.handle(writer, req)
+	ctx := utils.NewCtx(nil, nextLogID())
+	if h.traces != nil {
+		trace := utils.NewTrace(utils.CtxLogID(ctx), writer.RemoteAddr().String(), req)
+		ctx = utils.WithTrace(ctx, trace)
+		defer h.traces.add(trace)
+	}
+	ctx, cancel := h.withDeadline(ctx)
+	defer cancel()
+	begin := time.Now()
+	if h.tap != nil {
+		h.tapClient(writer, begin, req, nil)
+	}
+	resp, drop := h.handle(ctx, writer, req)
+	if drop {
+		_ = writer.Close()
+		return
+	}
 	if resp == nil {
 		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
 	}
 	if !resp.Response {
 		resp.SetReply(req)
 	}
+	// 仅对UDP响应限速，TCP无法伪造源地址
+	if addr, ok := writer.RemoteAddr().(*net.UDPAddr); ok && h.rrl != nil {
+		switch h.rrl.Check(addr.IP, req, resp) {
+		case rrlDrop:
+			_ = writer.Close()
+			return
+		case rrlSlip:
+			resp = slipResponse(req)
+		}
+	}
 	_ = writer.WriteMsg(resp)
 	_ = writer.Close()
+	if h.tap != nil {
+		h.tapClient(writer, begin, req, resp)
+	}
 }
 
-func (h *handlerImpl) handle(writer dns.ResponseWriter, req *dns.Msg) (resp *dns.Msg) {
+func (h *handlerImpl) handle(ctx context.Context, writer dns.ResponseWriter, req *dns.Msg) (resp *dns.Msg, drop bool) {
 	// region log
 	_info := struct {
-		blocked  bool
-		hitHosts bool
-		hitCache bool
-		matched  outbound.IGroup
-		fallback bool
-		redirect outbound.IGroup
+		view      *view
+		denied    bool
+		limited   bool
+		blocked   bool
+		hitHosts  bool
+		hitCache  bool
+		stale     bool
+		matched   outbound.IGroup
+		fallback  bool
+		redirect  outbound.IGroup
+		coalesced bool
+		err       error
 	}{}
 	begin := time.Now()
 	defer func() {
 		fields := logrus.Fields{
+			"trace":  utils.FormatLogID(utils.CtxLogID(ctx)),
 			"cost":   strconv.FormatInt(time.Since(begin).Milliseconds(), 10) + "ms",
 			"remote": writer.RemoteAddr().String(),
 		}
+		if _info.view != nil && _info.view.name != "" {
+			fields["view"] = _info.view.name
+		}
+		if _info.denied {
+			fields["denied"] = true
+		}
+		if _info.limited {
+			fields["limited"] = true
+		}
 		if _info.blocked {
 			fields["blocked"] = true
 		}
@@ -183,6 +333,9 @@ func (h *handlerImpl) handle(writer dns.ResponseWriter, req *dns.Msg) (resp *dns
 		if _info.hitCache {
 			fields["hit_cache"] = true
 		}
+		if _info.stale {
+			fields["stale"] = true
+		}
 		if len(req.Question) > 0 {
 			fields["question"] = req.Question[0].Name
 			fields["q_type"] = dns.TypeToString[req.Question[0].Qtype]
@@ -197,78 +350,343 @@ func (h *handlerImpl) handle(writer dns.ResponseWriter, req *dns.Msg) (resp *dns
 		if _info.redirect != nil {
 			fields["redir"] = _info.redirect.Name()
 		}
-		if resp == nil {
+		if _info.coalesced {
+			fields["coalesced"] = true
+		}
+		if _info.err != nil {
+			fields["error"] = _info.err.Error()
+		}
+		if drop {
+			fields["answer"] = "drop"
+		} else if resp == nil {
 			fields["answer"] = "nil"
 		} else {
 			fields["answer"] = len(resp.Answer)
+			if resp.Rcode != dns.RcodeSuccess {
+				fields["rcode"] = dns.RcodeToString[resp.Rcode]
+			}
 		}
-		if _info.blocked || _info.hitCache || _info.hitHosts {
+		if _info.denied || _info.limited || _info.blocked || _info.hitCache || _info.hitHosts {
 			logrus.WithFields(fields).Debug()
 		} else {
 			logrus.WithFields(fields).Info()
 		}
+		countQuery(req, resp, drop, _info.matched, _info.denied || _info.limited || _info.blocked,
+			_info.hitHosts, _info.hitCache)
+		if h.queryLog == nil {
+			return
+		}
+		entry := &querylog.Entry{
+			Time: begin, Trace: utils.FormatLogID(utils.CtxLogID(ctx)), Client: clientIP(writer.RemoteAddr()).String(),
+			Fallback: _info.fallback, Hosts: _info.hitHosts, Cache: _info.hitCache, Stale: _info.stale,
+			Coalesced: _info.coalesced,
+			Blocked:   _info.denied || _info.limited || _info.blocked,
+			Latency:   float64(time.Since(begin).Microseconds()) / 1000,
+		}
+		if _info.view != nil {
+			entry.View = _info.view.name
+		}
+		if len(req.Question) > 0 {
+			entry.Question, entry.QType = req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype]
+		}
+		if _info.matched != nil {
+			entry.Group = _info.matched.Name()
+		}
+		if _info.redirect != nil {
+			entry.Redirect = _info.redirect.Name()
+		}
+		if _info.err != nil {
+			entry.Error = _info.err.Error()
+		}
+		if resp != nil && !drop {
+			entry.Rcode = dns.RcodeToString[resp.Rcode]
+			for _, rr := range resp.Answer {
+				entry.Answers = append(entry.Answers, rr.String())
+			}
+		}
+		h.queryLog.Log(entry)
 	}()
 	// endregion
+	ip := clientIP(writer.RemoteAddr())
+	v := h.views.defaultView
+	_info.view = v
+	if utils.IsInternal(writer) {
+		utils.CtxDebug(ctx, "internal query, skip acl and rate limit")
+	} else {
+		if h.acl != nil && !h.acl.Allowed(ip) {
+			utils.CtxDebug(ctx, "client %s denied by acl", ip)
+			_info.denied = true
+			if h.acl.drop {
+				return nil, true
+			}
+			return errorResp(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "client not allowed"), false
+		}
+		v = h.views.Select(ip)
+		_info.view = v
+		if v.name != "" {
+			utils.CtxDebug(ctx, "client %s use view %q", ip, v.name)
+		}
+		if v.limiter != nil && !v.limiter.Allow(ip) {
+			utils.CtxDebug(ctx, "client %s rate limited", ip)
+			_info.limited = true
+			if v.limiter.drop {
+				rateLimitedCnt.Inc(v.name, ActionDrop)
+				return nil, true
+			}
+			rateLimitedCnt.Inc(v.name, ActionRefuse)
+			resp = new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeRefused)
+			return resp, false
+		}
+	}
 	for _, question := range req.Question {
-		if h.disableQTypes[question.Qtype] {
+		if v.disableQTypes[question.Qtype] {
+			utils.CtxDebug(ctx, "query type %s disabled", dns.TypeToString[question.Qtype])
 			_info.blocked = true
-			return nil // disabled
+			return h.failResp(req, outbound.ErrQTypeDisabled), false
 		}
 	}
-	if resp = h.hosts.Get(req); resp != nil {
+	if resp = v.hosts.Get(req); resp != nil {
+		utils.CtxDebug(ctx, "hit hosts")
 		_info.hitHosts = true
-		return resp
+		return resp, false
 	}
-	if resp = h.cache.Get(req); resp != nil {
+	if resp = h.cache.Get(v.name, req); resp != nil {
+		utils.CtxDebug(ctx, "hit cache")
 		_info.hitCache = true
-		return resp
+		return resp, false
 	}
 
-	// handle by matched group
-	var matched outbound.IGroup
-	for _, group := range h.groups {
-		if group.Match(req) {
-			matched = group
-			resp = group.Handle(req)
-			break
+	// serve-stale: 存在过期缓存时，上游失败或超时则返回过期响应
+	stale := h.cache.GetStale(v.name, req)
+	var res resolveResult
+	if stale == nil {
+		res = h.resolveShared(ctx, v, req)
+	} else {
+		// 返回过期响应后上游请求仍需在后台完成以刷新缓存，因此不使用本次请求的ctx
+		resCh := make(chan resolveResult, 1)
+		go func() {
+			ctx, cancel := h.withDeadline(utils.Detach(ctx))
+			defer cancel()
+			resCh <- h.resolveShared(ctx, v, req)
+		}()
+		var timeout <-chan time.Time
+		if h.staleTimeout > 0 {
+			timer := time.NewTimer(h.staleTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case res = <-resCh:
+			if res.err != nil && !errors.Is(res.err, outbound.ErrQTypeDisabled) {
+				utils.CtxDebug(ctx, "resolve failed, serve stale answer: %+v", res.err)
+				_info.stale, _info.err = true, res.err
+				return staleResp(req, stale), false
+			}
+		case <-timeout:
+			// 上游请求在后台继续进行，成功后刷新缓存
+			utils.CtxDebug(ctx, "resolve timeout, serve stale answer")
+			_info.stale = true
+			return staleResp(req, stale), false
 		}
 	}
+	_info.matched, _info.fallback, _info.redirect = res.matched, res.fallback, res.redirect
+	_info.coalesced = res.coalesced
+	if res.err != nil {
+		_info.err = res.err
+		_info.blocked = errors.Is(res.err, outbound.ErrQTypeDisabled)
+		return h.failResp(req, res.err), false
+	}
+	return res.resp, false
+}
+
+// resolveResult 通过分组解析请求的结果
+type resolveResult struct {
+	resp     *dns.Msg
+	err      error
+	matched  outbound.IGroup
+	fallback bool
+	redirect outbound.IGroup
+	// coalesced 复用了其它进行中请求的结果，本请求未请求上游
+	coalesced bool
+}
+
+// resolveShared 合并相同（缓存key一致）的并发请求，共享结果时复制响应并替换为各自请求的ID及问题
+func (h *handlerImpl) resolveShared(ctx context.Context, v *view, req *dns.Msg) resolveResult {
+	leader := false
+	res, shared := h.flights.Do(cache.Key(v.name, req), func() resolveResult {
+		leader = true
+		return h.resolve(ctx, v, req)
+	})
+	if shared && !leader {
+		utils.CtxDebug(ctx, "reuse result of in-flight query")
+		res.coalesced = true
+	}
+	if shared && res.resp != nil {
+		resp := res.resp.Copy()
+		resp.Id = req.Id
+		resp.Question = append([]dns.Question(nil), req.Question...)
+		res.resp = resp
+	}
+	return res
+}
+
+// resolve 使用视图内匹配的分组解析请求，必要时重定向到其它分组，成功后写入缓存
+func (h *handlerImpl) resolve(ctx context.Context, v *view, req *dns.Msg) (res resolveResult) {
+	// handle by matched group
+	matched := v.groups.Match(req)
 	if matched == nil {
-		matched = h.fallbackGroup
-		resp = h.fallbackGroup.Handle(req)
-		_info.fallback = true
+		matched = v.fallbackGroup
+		res.fallback = true
 	}
-	_info.matched = matched
+	res.matched = matched
+	utils.CtxDebug(ctx, "match group %q, fallback: %t", matched.Name(), res.fallback)
+	res.resp, res.err = matched.Handle(ctx, req)
 
 	// redirect
 	if h.redirector != nil {
-		if group := h.redirector(matched, req, resp); group != nil {
+		if group := h.redirector(ctx, matched, req, res.resp); group != nil {
 			matched = group
-			resp = group.Handle(req)
-			_info.redirect = group
+			res.resp, res.err = group.Handle(ctx, req)
+			res.redirect = group
 		}
 	}
+	if res.err != nil {
+		return res
+	}
 
 	// finally
-	matched.PostProcess(req, resp)
-	h.cache.Set(req, resp)
+	matched.PostProcess(req, res.resp)
+	h.cache.Set(v.name, matched.Name(), req, res.resp)
+	return res
+}
+
+// migrateCache 在ttl相关配置未变化时将旧handler的缓存迁移至当前handler，
+// 已删除视图及缓存策略发生变化的分组的缓存不迁移，开启flush_changed_groups时不迁移路由分组发生变化的缓存
+func (h *handlerImpl) migrateCache(old *handlerImpl) {
+	oc, nc := old.cacheConf, h.cacheConf
+	if oc.Size <= 0 || nc.Size <= 0 || oc.MinTTL != nc.MinTTL || oc.MaxTTL != nc.MaxTTL ||
+		oc.NegativeMaxTTL != nc.NegativeMaxTTL {
+		logrus.Infof("cache settings changed, skip migrating cache")
+		return
+	}
+	count := h.cache.Migrate(old.cache, func(view, group string, question dns.Question) bool {
+		newGroup := h.routeGroup(view, question)
+		if newGroup == "" || !sameCachePolicy(old.groupConfs[group], h.groupConfs[group]) {
+			return false
+		}
+		return !nc.FlushChangedGroups || newGroup == old.routeGroup(view, question)
+	})
+	logrus.Infof("migrate %d cache items", count)
+}
+
+// sameCachePolicy 判断分组的缓存策略是否一致
+func sameCachePolicy(a, b config.Group) bool {
+	return a.CacheMinTTL == b.CacheMinTTL && a.CacheMaxTTL == b.CacheMaxTTL && a.DisableCache == b.DisableCache
+}
+
+// routeGroup 返回视图内请求匹配的分组名，不考虑重定向。视图不存在时返回空字符串
+func (h *handlerImpl) routeGroup(viewName string, question dns.Question) string {
+	v := h.views.Get(viewName)
+	if v == nil {
+		return ""
+	}
+	group := v.groups.Match(&dns.Msg{Question: []dns.Question{question}})
+	if group == nil {
+		group = v.fallbackGroup
+	}
+	return group.Name()
+}
+
+// prefetch 由缓存回调，使用视图内的分组重新解析即将过期的热门请求
+func (h *handlerImpl) prefetch(viewName string, req *dns.Msg) {
+	v := h.views.Get(viewName)
+	if v == nil {
+		return
+	}
+	ctx, cancel := h.withDeadline(utils.NewCtx(nil, nextLogID()))
+	defer cancel()
+	res := h.resolveShared(ctx, v, req)
+	fields := logrus.Fields{
+		"trace":    utils.FormatLogID(utils.CtxLogID(ctx)),
+		"question": req.Question[0].Name,
+		"q_type":   dns.TypeToString[req.Question[0].Qtype],
+	}
+	if res.matched != nil {
+		fields["group"] = res.matched.Name()
+	}
+	if res.err != nil {
+		logrus.WithFields(fields).Warnf("prefetch failed: %+v", res.err)
+		return
+	}
+	logrus.WithFields(fields).Debug("prefetch success")
+}
+
+// staleResp 为过期响应附加Stale Answer错误码
+func staleResp(req, stale *dns.Msg) *dns.Msg {
+	utils.SetEDE(req, stale, dns.ExtendedErrorCodeStaleAnswer, "")
+	return stale
+}
+
+// failResp 根据分组返回的错误构建响应：屏蔽的请求类型使用disabled_rcode，上游失败时返回SERVFAIL
+func (h *handlerImpl) failResp(req *dns.Msg, err error) *dns.Msg {
+	var upstreamErr *outbound.UpstreamError
+	switch {
+	case errors.Is(err, outbound.ErrQTypeDisabled):
+		return errorResp(req, h.disabledRcode, dns.ExtendedErrorCodeBlocked, "query type disabled")
+	case errors.As(err, &upstreamErr) && upstreamErr.IsNetwork():
+		return errorResp(req, dns.RcodeServerFailure, dns.ExtendedErrorCodeNetworkError, "upstream network error")
+	}
+	return errorResp(req, dns.RcodeServerFailure, dns.ExtendedErrorCodeNoReachableAuthority, "no upstream available")
+}
+
+// errorResp 构建指定rcode的响应，请求携带EDNS时附加Extended DNS Error
+func errorResp(req *dns.Msg, rcode int, edeCode uint16, text string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	utils.SetEDE(req, resp, edeCode, text)
 	return resp
 }
 
+// parseRcode 解析屏蔽请求类型时响应的rcode
+func parseRcode(val string) (int, error) {
+	switch strings.ToLower(val) {
+	case "", "noerror", "nodata":
+		return dns.RcodeSuccess, nil
+	case "nxdomain":
+		return dns.RcodeNameError, nil
+	case "refused":
+		return dns.RcodeRefused, nil
+	}
+	return 0, fmt.Errorf("unknown rcode: %q", val)
+}
+
 func (h *handlerImpl) start() {
-	for _, group := range h.groups {
+	for _, group := range h.groups.All() {
 		group.Start(h)
 	}
 	h.cache.Start()
+	if h.queryLog != nil {
+		h.queryLog.Start()
+	}
+	if h.tap != nil {
+		h.tap.Start()
+	}
 	logrus.Debugf("start handler success")
 }
 
 func (h *handlerImpl) stop() {
 	logrus.Debugf("stop handler")
-	for _, group := range h.groups {
+	for _, group := range h.groups.All() {
 		group.Stop()
 	}
 	h.cache.Stop()
+	if h.queryLog != nil && !h.queryLogMoved {
+		h.queryLog.Stop()
+	}
+	if h.tap != nil && !h.tapMoved {
+		h.tap.Stop()
+	}
 	logrus.Debugf("stop handler success")
 }
 
@@ -1,13 +1,28 @@
 package inbound
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
 	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/metrics"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/querylog"
 	"github.com/wolf-joe/ts-dns/utils"
+	"github.com/wolf-joe/ts-dns/utils/mock"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func buildReq(name string, qType uint16) *dns.Msg {
@@ -64,6 +79,173 @@ func TestNewHandler(t *testing.T) {
 	t.Log(err)
 }
 
+func TestHandlerReloadCache(t *testing.T) {
+	buildConf := func(group string) config.Conf {
+		return config.Conf{
+			Cache: config.CacheConf{Size: 10, FlushChangedGroups: true},
+			Groups: map[string]config.Group{
+				"fallback": {}, group: {Rules: []string{"a.cn"}},
+			},
+		}
+	}
+	h, err := NewHandler(buildConf("a"))
+	assert.Nil(t, err)
+	defer h.Stop()
+	impl := (*handlerImpl)(h.(*handlerWrapper).handlerPtr)
+	rr, _ := dns.NewRR("a.cn. 60 IN A 1.1.1.1")
+	impl.cache.Set("", "", buildReq("a.cn", dns.TypeA), &dns.Msg{Answer: []dns.RR{rr}})
+	impl.cache.Set("", "", buildReq("b.cn", dns.TypeA), &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+
+	// group unchanged, keep all
+	assert.Nil(t, h.ReloadConfig(buildConf("a")))
+	impl = (*handlerImpl)(h.(*handlerWrapper).handlerPtr)
+	assert.NotNil(t, impl.cache.Get("", buildReq("a.cn", dns.TypeA)))
+	assert.NotNil(t, impl.cache.Get("", buildReq("b.cn", dns.TypeA)))
+
+	// a.cn moved to another group
+	assert.Nil(t, h.ReloadConfig(buildConf("b")))
+	impl = (*handlerImpl)(h.(*handlerWrapper).handlerPtr)
+	assert.Nil(t, impl.cache.Get("", buildReq("a.cn", dns.TypeA)))
+	assert.NotNil(t, impl.cache.Get("", buildReq("b.cn", dns.TypeA)))
+
+	// ttl settings changed, flush all
+	conf := buildConf("b")
+	conf.Cache.MinTTL = 10
+	assert.Nil(t, h.ReloadConfig(conf))
+	impl = (*handlerImpl)(h.(*handlerWrapper).handlerPtr)
+	assert.Nil(t, impl.cache.Get("", buildReq("b.cn", dns.TypeA)))
+}
+
+func TestHandlerConcurrentReload(t *testing.T) {
+	conf := config.Conf{
+		Groups:   map[string]config.Group{"fallback": {}},
+		Hosts:    map[string]string{"z.cn": "1.1.1.1"},
+		QueryLog: config.QueryLogConf{File: filepath.Join(t.TempDir(), "query.log")},
+	}
+	h, err := NewHandler(conf)
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, h.ReloadConfig(conf))
+		}()
+	}
+	wg.Wait()
+	// query log is held by the live handler and must not be closed by intermediate handlers
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+	h.Stop()
+	content, err := os.ReadFile(conf.QueryLog.File)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(content), "\n"))
+}
+
+func TestHandlerReloadSnapshot(t *testing.T) {
+	conf := config.Conf{
+		Cache:  config.CacheConf{Size: 10, PersistFile: filepath.Join(t.TempDir(), "cache.bin")},
+		Groups: map[string]config.Group{"fallback": {}},
+	}
+	req := buildReq("a.cn", dns.TypeA)
+	rr, _ := dns.NewRR("a.cn. 60 IN A 1.1.1.1")
+	h, err := NewHandler(conf)
+	assert.Nil(t, err)
+	h.Cache().Set("", "", req, &dns.Msg{Answer: []dns.RR{rr}})
+	h.Stop()
+
+	// snapshot is loaded at boot
+	h, err = NewHandler(conf)
+	assert.Nil(t, err)
+	defer h.Stop()
+	assert.NotNil(t, h.Cache().Get("", req))
+
+	// flushed entries are not restored by reload
+	h.Cache().Flush()
+	assert.Nil(t, h.ReloadConfig(conf))
+	assert.Nil(t, h.Cache().Get("", req))
+
+	// ttl settings changed, entries dropped by migration are not restored
+	h.Cache().Set("", "", req, &dns.Msg{Answer: []dns.RR{dns.Copy(rr)}})
+	conf.Cache.MinTTL = 10
+	assert.Nil(t, h.ReloadConfig(conf))
+	assert.Nil(t, h.Cache().Get("", req))
+	assert.Equal(t, 0, h.Cache().Stats().Size)
+}
+
+// readTapFrames 读取dnstap文件，返回控制帧类型及数据帧数量
+func readTapFrames(t *testing.T, path string) (controls []uint32, frames int) {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer func() { _ = file.Close() }()
+	for {
+		var size uint32
+		if binary.Read(file, binary.BigEndian, &size) != nil {
+			return
+		}
+		if size == 0 {
+			var typ uint32
+			assert.Nil(t, binary.Read(file, binary.BigEndian, &size))
+			assert.Nil(t, binary.Read(file, binary.BigEndian, &typ))
+			controls = append(controls, typ)
+			size -= 4
+		} else {
+			frames++
+		}
+		_, err = file.Seek(int64(size), io.SeekCurrent)
+		assert.Nil(t, err)
+	}
+}
+
+func TestHandlerReloadDnstap(t *testing.T) {
+	conf := config.Conf{
+		Groups: map[string]config.Group{"fallback": {}},
+		Hosts:  map[string]string{"z.cn": "1.1.1.1"},
+		Dnstap: config.DnstapConf{File: filepath.Join(t.TempDir(), "tap.fstrm"), Identity: "identity-a"},
+	}
+	h, err := NewHandler(conf)
+	assert.Nil(t, err)
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+	// dnstap settings changed but file unchanged, old output must be stopped before new one opens the file
+	conf.Dnstap.Identity = "b"
+	assert.Nil(t, h.ReloadConfig(conf))
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+	h.Stop()
+
+	// START, client query & response, STOP
+	controls, frames := readTapFrames(t, conf.Dnstap.File)
+	assert.Equal(t, []uint32{2, 3}, controls)
+	assert.Equal(t, 2, frames)
+}
+
+func TestHandlerReloadQueryLog(t *testing.T) {
+	conf := config.Conf{
+		Groups:   map[string]config.Group{"fallback": {}},
+		Hosts:    map[string]string{"z.cn": "1.1.1.1"},
+		QueryLog: config.QueryLogConf{File: filepath.Join(t.TempDir(), "query.log")},
+	}
+	h, err := NewHandler(conf)
+	assert.Nil(t, err)
+	old := (*handlerImpl)(h.(*handlerWrapper).handlerPtr)
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+	// query log settings changed but file unchanged, old logger is stopped before the new one starts
+	conf.QueryLog.OnlyFailed = true
+	assert.Nil(t, h.ReloadConfig(conf))
+	content, err := os.ReadFile(conf.QueryLog.File)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(content), "\n"))
+	old.queryLog.Log(&querylog.Entry{Question: "old.cn", Blocked: true}) // ignored after stop
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("b.cn", dns.TypeA))
+	h.Stop()
+
+	content, err = os.ReadFile(conf.QueryLog.File)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], `"question":"z.cn"`)
+	assert.Contains(t, lines[1], `"question":"b.cn"`)
+}
+
 func Test_newHandle(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	defaultConf := config.Conf{
@@ -116,6 +298,116 @@ func Test_newHandle(t *testing.T) {
 		h.ServeDNS(rw, buildReq("v6.cn", dns.TypeAAAA))
 		assert.NotNil(t, rw.Msg)
 		assert.Nil(t, rw.Msg.Answer)
+		assert.Equal(t, dns.RcodeSuccess, rw.Msg.Rcode)
+
+		conf.DisabledRcode = "???"
+		_, err = newHandle(conf)
+		assert.NotNil(t, err)
+
+		conf.DisabledRcode = "nxdomain"
+		h, err = newHandle(conf)
+		assert.Nil(t, err)
+		req := buildReq("v6.cn", dns.TypeAAAA)
+		req.SetEdns0(4096, false)
+		rw = utils.NewFakeRespWriter()
+		h.ServeDNS(rw, req)
+		assert.Equal(t, dns.RcodeNameError, rw.Msg.Rcode)
+		ede := rw.Msg.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		assert.Equal(t, dns.ExtendedErrorCodeBlocked, ede.InfoCode)
+	})
+	t.Run("servfail", func(t *testing.T) {
+		conf := defaultConf
+		h, err := newHandle(conf)
+		assert.Nil(t, err)
+		// fallback组未配置上游
+		req := buildReq("b.cn", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rw := utils.NewFakeRespWriter()
+		h.ServeDNS(rw, req)
+		assert.Equal(t, dns.RcodeServerFailure, rw.Msg.Rcode)
+		ede := rw.Msg.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		assert.Equal(t, dns.ExtendedErrorCodeNoReachableAuthority, ede.InfoCode)
+	})
+	t.Run("query_timeout", func(t *testing.T) {
+		conf := defaultConf
+		conf.QueryTimeout = -1
+		_, err := newHandle(conf)
+		assert.NotNil(t, err)
+
+		conf.QueryTimeout = 50
+		h, err := newHandle(conf)
+		assert.Nil(t, err)
+		h.views.defaultView.fallbackGroup = mock.Group{
+			MockHandle: func(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+				<-ctx.Done()
+				return nil, &outbound.UpstreamError{Group: "fallback", Errs: []error{ctx.Err()}}
+			},
+			MockName: func() string { return "fallback" },
+		}
+		req := buildReq("b.cn", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rw := utils.NewFakeRespWriter()
+		begin := time.Now()
+		h.ServeDNS(rw, req)
+		assert.Less(t, time.Since(begin), time.Second)
+		assert.Equal(t, dns.RcodeServerFailure, rw.Msg.Rcode)
+		ede := rw.Msg.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		assert.Equal(t, dns.ExtendedErrorCodeNetworkError, ede.InfoCode)
+	})
+	t.Run("query_log", func(t *testing.T) {
+		conf := defaultConf
+		conf.QueryLog.File = filepath.Join(t.TempDir(), "query.log")
+		h, err := newHandle(conf)
+		assert.Nil(t, err)
+		h.start()
+		h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+		h.ServeDNS(utils.NewFakeRespWriter(), buildReq("b.cn", dns.TypeA))
+		h.stop()
+
+		content, err := os.ReadFile(conf.QueryLog.File)
+		assert.Nil(t, err)
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		assert.Equal(t, 2, len(lines))
+		entry := querylog.Entry{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal(t, "z.cn", entry.Question)
+		assert.True(t, entry.Hosts)
+		assert.Equal(t, "NOERROR", entry.Rcode)
+		assert.Equal(t, 1, len(entry.Answers))
+		assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+		assert.Equal(t, "fallback", entry.Group)
+		assert.Equal(t, "SERVFAIL", entry.Rcode)
+		assert.NotEmpty(t, entry.Error)
+	})
+	t.Run("metrics", func(t *testing.T) {
+		h, err := newHandle(defaultConf)
+		assert.Nil(t, err)
+		h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+		h.ServeDNS(utils.NewFakeRespWriter(), buildReq("b.cn", dns.TypeTXT))
+
+		buf := new(bytes.Buffer)
+		_, err = metrics.Default.WriteTo(buf)
+		assert.Nil(t, err)
+		assert.Contains(t, buf.String(), `tsdns_queries_total{qtype="A",group="",result="hosts",rcode="NOERROR"}`)
+		assert.Contains(t, buf.String(), `tsdns_queries_total{qtype="TXT",group="fallback",result="upstream",rcode="SERVFAIL"} 1`)
+	})
+	t.Run("dnstap", func(t *testing.T) {
+		conf := defaultConf
+		conf.Dnstap.File = filepath.Join(t.TempDir(), "tap.fstrm")
+		h, err := newHandle(conf)
+		assert.Nil(t, err)
+		h.start()
+		h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+		req, resp := buildReq("b.cn", dns.TypeA), new(dns.Msg)
+		caller := outbound.NewDNSCaller("1.1.1.1:53", "udp", nil)
+		h.tapForwarder(context.Background(), "fallback", caller, req, resp, time.Now(), nil)
+		h.tapForwarder(context.Background(), "fallback", caller, req, nil, time.Now(), errors.New("timeout"))
+		h.stop()
+
+		// START, 2 client messages, 3 forwarder messages, STOP
+		controls, frames := readTapFrames(t, conf.Dnstap.File)
+		assert.Equal(t, []uint32{2, 3}, controls)
+		assert.Equal(t, 5, frames)
 	})
 	t.Run("cache", func(t *testing.T) {
 		conf := defaultConf
@@ -125,7 +417,7 @@ func Test_newHandle(t *testing.T) {
 		assert.NotNil(t, h)
 
 		req := buildReq("a.cn", dns.TypeA)
-		h.cache.Set(req, &dns.Msg{
+		h.cache.Set("", "", req, &dns.Msg{
 			Answer: []dns.RR{&dns.A{}, &dns.AAAA{}},
 		})
 		rw := utils.NewFakeRespWriter()
@@ -133,6 +425,26 @@ func Test_newHandle(t *testing.T) {
 		assert.NotNil(t, rw.Msg)
 		assert.Equal(t, 2, len(rw.Msg.Answer))
 	})
+	t.Run("stale", func(t *testing.T) {
+		conf := defaultConf
+		conf.Cache = config.CacheConf{Size: 10, MinTTL: 1, MaxTTL: 1, StaleTTL: 60}
+		h, err := newHandle(conf)
+		assert.Nil(t, err)
+
+		req := buildReq("a.cn", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rr, _ := dns.NewRR("a.cn. 1 IN A 1.1.1.1")
+		h.cache.Set("", "", req, &dns.Msg{Answer: []dns.RR{rr}})
+		time.Sleep(2 * time.Second)
+		// fallback组未配置上游，返回过期的缓存
+		rw := utils.NewFakeRespWriter()
+		h.ServeDNS(rw, req)
+		assert.Equal(t, dns.RcodeSuccess, rw.Msg.Rcode)
+		assert.Equal(t, 1, len(rw.Msg.Answer))
+		assert.Equal(t, uint32(cache.DefaultStaleAnswerTTL.Seconds()), rw.Msg.Answer[0].Header().Ttl)
+		ede := rw.Msg.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, ede.InfoCode)
+	})
 	t.Run("group", func(t *testing.T) {
 		conf := defaultConf
 		conf.Groups["a"] = config.Group{
@@ -143,7 +455,7 @@ func Test_newHandle(t *testing.T) {
 		assert.NotNil(t, h)
 
 		var srcGroup outbound.IGroup
-		h.redirector = func(src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup {
+		h.redirector = func(_ context.Context, src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup {
 			srcGroup = src
 			return src
 		}
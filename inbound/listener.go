@@ -0,0 +1,205 @@
+package inbound
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+// DoH服务的超时设置，避免慢速或空闲的客户端长期占用连接
+const (
+	dohReadHeaderTimeout = 5 * time.Second
+	dohReadTimeout       = 10 * time.Second
+	dohWriteTimeout      = 30 * time.Second // 需覆盖请求上游的耗时
+	dohIdleTimeout       = 2 * time.Minute
+)
+
+// Listeners 管理所有监听服务，Reload时按配置新增、重启或关闭监听
+type Listeners struct {
+	handler dns.Handler
+	lock    sync.Mutex
+	running map[string]*listener // key: protocol://addr
+}
+
+// NewListeners 创建监听管理器，所有监听将请求交由handler处理
+func NewListeners(handler dns.Handler) *Listeners {
+	return &Listeners{handler: handler, running: map[string]*listener{}}
+}
+
+// Reload 按配置调整监听：关闭已移除或配置变化的监听，启动新增的监听，并重新读取tls证书
+func (ls *Listeners) Reload(confs []config.ListenerConf) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	wanted := make(map[string]config.ListenerConf, len(confs))
+	for _, lc := range confs {
+		key := listenerKey(lc)
+		if _, exists := wanted[key]; exists {
+			return fmt.Errorf("duplicate listener %s", key)
+		}
+		wanted[key] = lc
+	}
+	// 关闭已移除或配置变化的监听
+	for key, l := range ls.running {
+		if lc, exists := wanted[key]; !exists || !l.sameConf(lc) {
+			l.stop()
+			delete(ls.running, key)
+		}
+	}
+	// 启动新增监听，已有监听仅重载证书
+	var errs []error
+	for key, lc := range wanted {
+		if l, exists := ls.running[key]; exists {
+			if err := l.reloadCert(); err != nil {
+				errs = append(errs, fmt.Errorf("reload certificate for %s failed: %w", key, err))
+			}
+			continue
+		}
+		l, err := startListener(lc, ls.handler)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("start listener %s failed: %w", key, err))
+			continue
+		}
+		ls.running[key] = l
+	}
+	if len(errs) > 0 {
+		msgs := make([]string, 0, len(errs))
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// Stop 关闭所有监听
+func (ls *Listeners) Stop() {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	for key, l := range ls.running {
+		l.stop()
+		delete(ls.running, key)
+	}
+}
+
+func listenerKey(lc config.ListenerConf) string {
+	return lc.Protocol + "://" + lc.Addr
+}
+
+type listener struct {
+	conf  config.ListenerConf
+	certs *CertHolder
+	// dnsSrv/httpSrv二选一
+	dnsSrv  *dns.Server
+	httpSrv *http.Server
+	done    chan struct{}
+}
+
+func startListener(lc config.ListenerConf, handler dns.Handler) (*listener, error) {
+	l := &listener{conf: lc, done: make(chan struct{})}
+	var tlsConf *tls.Config
+	if lc.Protocol == config.ProtocolTLS || lc.Protocol == config.ProtocolHTTPS {
+		l.certs = new(CertHolder)
+		if err := l.reloadCert(); err != nil {
+			return nil, err
+		}
+		tlsConf = l.certs.TLSConfig()
+	}
+	var serve func() error
+	switch lc.Protocol {
+	case config.ProtocolUDP:
+		conn, err := net.ListenPacket("udp", lc.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l.dnsSrv = &dns.Server{PacketConn: conn, Net: "udp", Handler: handler}
+		serve = l.dnsSrv.ActivateAndServe
+	case config.ProtocolTCP, config.ProtocolTLS:
+		ln, err := net.Listen("tcp", lc.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l.dnsSrv = &dns.Server{Listener: ln, Net: "tcp", Handler: handler}
+		if tlsConf != nil {
+			l.dnsSrv.Listener = tls.NewListener(ln, tlsConf)
+			l.dnsSrv.Net, l.dnsSrv.TLSConfig = "tcp-tls", tlsConf
+		}
+		serve = l.dnsSrv.ActivateAndServe
+	case config.ProtocolHTTP, config.ProtocolHTTPS:
+		ln, err := net.Listen("tcp", lc.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l.httpSrv = &http.Server{
+			Handler:           NewDoHHandler(handler, lc.Path, lc.TrustXFF),
+			TLSConfig:         tlsConf,
+			ReadHeaderTimeout: dohReadHeaderTimeout,
+			ReadTimeout:       dohReadTimeout,
+			WriteTimeout:      dohWriteTimeout,
+			IdleTimeout:       dohIdleTimeout,
+		}
+		serve = func() error { return l.httpSrv.Serve(ln) }
+		if tlsConf != nil {
+			serve = func() error { return l.httpSrv.ServeTLS(ln, "", "") }
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol: %q", lc.Protocol)
+	}
+	// 等待dns.Server启动完成，避免stop时Shutdown失败
+	started := make(chan struct{})
+	if l.dnsSrv != nil {
+		l.dnsSrv.NotifyStartedFunc = func() { close(started) }
+	} else {
+		close(started)
+	}
+	go func() {
+		defer close(l.done)
+		logrus.Infof("listen on %s/%s", lc.Addr, lc.Protocol)
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("listener %s stopped: %+v", listenerKey(lc), err)
+		}
+	}()
+	select {
+	case <-started:
+	case <-l.done:
+		return nil, errors.New("listener exited unexpectedly")
+	}
+	return l, nil
+}
+
+// sameConf 判断配置是否无需重启监听
+func (l *listener) sameConf(lc config.ListenerConf) bool {
+	return l.conf == lc
+}
+
+func (l *listener) reloadCert() error {
+	if l.certs == nil {
+		return nil
+	}
+	return l.certs.Load(l.conf.TLSCert, l.conf.TLSKey)
+}
+
+func (l *listener) stop() {
+	logrus.Infof("stop listening on %s/%s", l.conf.Addr, l.conf.Protocol)
+	var err error
+	if l.dnsSrv != nil {
+		err = l.dnsSrv.Shutdown()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		err = l.httpSrv.Shutdown(ctx)
+		cancel()
+	}
+	if err != nil {
+		logrus.Warnf("stop listener %s failed: %+v", listenerKey(l.conf), err)
+	}
+	<-l.done
+}
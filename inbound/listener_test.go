@@ -0,0 +1,80 @@
+package inbound
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().String()
+}
+
+func TestListeners(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		_ = w.WriteMsg(resp)
+	})
+	query := func(network, addr string) error {
+		req := new(dns.Msg)
+		req.SetQuestion("z.cn.", dns.TypeA)
+		_, _, err := (&dns.Client{Net: network}).Exchange(req, addr)
+		return err
+	}
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	servers := NewListeners(handler)
+	defer servers.Stop()
+
+	err := servers.Reload([]config.ListenerConf{
+		{Addr: addr1, Protocol: config.ProtocolUDP},
+		{Addr: addr1, Protocol: config.ProtocolTCP},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, query("udp", addr1))
+	assert.Nil(t, query("tcp", addr1))
+
+	// 移除tcp监听，新增另一个地址
+	err = servers.Reload([]config.ListenerConf{
+		{Addr: addr1, Protocol: config.ProtocolUDP},
+		{Addr: addr2, Protocol: config.ProtocolTCP},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, query("udp", addr1))
+	assert.NotNil(t, query("tcp", addr1))
+	assert.Nil(t, query("tcp", addr2))
+
+	// 重复/错误配置
+	err = servers.Reload([]config.ListenerConf{
+		{Addr: addr1, Protocol: config.ProtocolUDP},
+		{Addr: addr1, Protocol: config.ProtocolUDP},
+	})
+	assert.NotNil(t, err)
+	err = servers.Reload([]config.ListenerConf{
+		{Addr: addr1, Protocol: config.ProtocolTLS, TLSCert: "not_exists.crt", TLSKey: "not_exists.key"},
+		{Addr: addr2, Protocol: "quic"},
+	})
+	assert.NotNil(t, err)
+	t.Log(err)
+
+	servers.Stop()
+	assert.NotNil(t, query("tcp", addr2))
+}
+
+func TestDoHListenerTimeouts(t *testing.T) {
+	l, err := startListener(config.ListenerConf{Addr: freeAddr(t), Protocol: config.ProtocolHTTP}, dns.HandlerFunc(
+		func(w dns.ResponseWriter, req *dns.Msg) {}))
+	assert.Nil(t, err)
+	defer l.stop()
+	// 慢速或空闲的客户端不能长期占用连接
+	assert.Equal(t, dohReadHeaderTimeout, l.httpSrv.ReadHeaderTimeout)
+	assert.Equal(t, dohReadTimeout, l.httpSrv.ReadTimeout)
+	assert.Equal(t, dohWriteTimeout, l.httpSrv.WriteTimeout)
+	assert.Equal(t, dohIdleTimeout, l.httpSrv.IdleTimeout)
+}
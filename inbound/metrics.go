@@ -0,0 +1,55 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/metrics"
+	"github.com/wolf-joe/ts-dns/outbound"
+)
+
+// 查询的处理结果
+const (
+	resultHosts    = "hosts"
+	resultCache    = "cache"
+	resultUpstream = "upstream"
+	resultBlocked  = "blocked" // 被拒绝、限速或屏蔽
+)
+
+// queryCnt group为匹配的分组（重定向前），命中hosts及缓存时为空；未响应时rcode为空
+var queryCnt = metrics.NewCounterVec("tsdns_queries_total",
+	"Queries handled, by query type, matched group, result and response code.", "qtype", "group", "result", "rcode")
+
+// rateLimitedCnt 被限速的查询数，action为refuse或drop
+var rateLimitedCnt = metrics.NewCounterVec("tsdns_rate_limited_queries_total",
+	"Queries refused or dropped by per-client rate limiting.", "view", "action")
+
+// rrlActionCnt 被响应限速丢弃或截断的UDP响应数，log_only为true时响应实际未被处理
+var rrlActionCnt = metrics.NewCounterVec("tsdns_rrl_responses_total",
+	"UDP responses dropped or slipped (truncated) by response rate limiting.", "action", "log_only")
+
+func init() {
+	metrics.Default.MustRegister(queryCnt, rateLimitedCnt, rrlActionCnt)
+}
+
+// countQuery 记录查询的处理结果
+func countQuery(req, resp *dns.Msg, drop bool, matched outbound.IGroup, blocked, hitHosts, hitCache bool) {
+	var qType, group, rcode string
+	if len(req.Question) > 0 {
+		qType = dns.TypeToString[req.Question[0].Qtype]
+	}
+	if matched != nil {
+		group = matched.Name()
+	}
+	if resp != nil && !drop {
+		rcode = dns.RcodeToString[resp.Rcode]
+	}
+	result := resultUpstream
+	switch {
+	case blocked:
+		result = resultBlocked
+	case hitHosts:
+		result = resultHosts
+	case hitCache:
+		result = resultCache
+	}
+	queryCnt.Inc(qType, group, result, rcode)
+}
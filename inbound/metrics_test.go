@@ -0,0 +1,28 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/metrics"
+)
+
+// metricValue 返回默认指标集合中series（指标名及标签）的当前值，不存在时返回0
+func metricValue(t *testing.T, series string) float64 {
+	buf := new(bytes.Buffer)
+	_, err := metrics.Default.WriteTo(buf)
+	assert.Nil(t, err)
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, series+" ") {
+			val, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			assert.Nil(t, err)
+			return val
+		}
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package inbound
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+const (
+	defaultIPv4Prefix = 32
+	defaultIPv6Prefix = 64
+	bucketIdleTimeout = time.Minute // 超过该时间未使用的令牌桶会被清理
+)
+
+// rateLimiter 按客户端地址（网段）进行令牌桶限速
+type rateLimiter struct {
+	qps    float64
+	burst  float64
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+	drop   bool // 超出限制时是否直接丢弃请求
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// newRateLimiter 根据配置创建限速器，qps不为正数时返回nil（不限速）
+func newRateLimiter(conf config.RateLimitConf) (*rateLimiter, error) {
+	if conf.QPS <= 0 {
+		return nil, nil
+	}
+	l := &rateLimiter{
+		qps:     conf.QPS,
+		burst:   float64(conf.Burst),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+	if conf.Burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(conf.QPS))
+	}
+	v4Prefix, v6Prefix := conf.IPv4Prefix, conf.IPv6Prefix
+	if v4Prefix == 0 {
+		v4Prefix = defaultIPv4Prefix
+	}
+	if v6Prefix == 0 {
+		v6Prefix = defaultIPv6Prefix
+	}
+	if v4Prefix < 0 || v4Prefix > 32 {
+		return nil, fmt.Errorf("invalid ipv4_prefix: %d", conf.IPv4Prefix)
+	}
+	if v6Prefix < 0 || v6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ipv6_prefix: %d", conf.IPv6Prefix)
+	}
+	l.v4Mask, l.v6Mask = net.CIDRMask(v4Prefix, 32), net.CIDRMask(v6Prefix, 128)
+	var err error
+	if l.drop, err = parseAction(conf.Action); err != nil {
+		return nil, err
+	}
+	l.lastSweep = l.now()
+	return l, nil
+}
+
+// bucketKey 将客户端地址按前缀长度聚合为网段
+func (l *rateLimiter) bucketKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(l.v4Mask).String()
+	}
+	return ip.Mask(l.v6Mask).String()
+}
+
+// Allow 消耗客户端所在网段的一个令牌，令牌不足时返回false
+func (l *rateLimiter) Allow(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	key, now := l.bucketKey(ip), l.now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastSweep) >= bucketIdleTimeout {
+		l.sweep(now)
+	}
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.qps)
+	b.lastSeen = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep 清理长时间未使用的令牌桶，调用方需持有锁
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= bucketIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
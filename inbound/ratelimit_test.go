@@ -0,0 +1,78 @@
+package inbound
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l, err := newRateLimiter(config.RateLimitConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	_, err = newRateLimiter(config.RateLimitConf{QPS: 1, IPv4Prefix: 33})
+	assert.NotNil(t, err)
+	_, err = newRateLimiter(config.RateLimitConf{QPS: 1, IPv6Prefix: -1})
+	assert.NotNil(t, err)
+	_, err = newRateLimiter(config.RateLimitConf{QPS: 1, Action: "???"})
+	assert.NotNil(t, err)
+
+	l, err = newRateLimiter(config.RateLimitConf{QPS: 2, IPv4Prefix: 24})
+	assert.Nil(t, err)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	ip1, ip2, ip3 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.1.1")
+	// burst默认为qps
+	assert.True(t, l.Allow(ip1))
+	assert.True(t, l.Allow(ip2))
+	assert.False(t, l.Allow(ip1)) // 同一/24网段共享令牌桶
+	assert.True(t, l.Allow(ip3))
+	assert.True(t, l.Allow(nil))
+	// 令牌恢复
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow(ip1))
+	assert.False(t, l.Allow(ip1))
+	// ipv6按/64聚合
+	assert.True(t, l.Allow(net.ParseIP("fd00::1")))
+	assert.True(t, l.Allow(net.ParseIP("fd00::2")))
+	assert.False(t, l.Allow(net.ParseIP("fd00::3")))
+	assert.True(t, l.Allow(net.ParseIP("fd00:0:0:1::1")))
+	// 清理闲置令牌桶
+	now = now.Add(2 * bucketIdleTimeout)
+	assert.True(t, l.Allow(ip1))
+	assert.Equal(t, 1, len(l.buckets))
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	conf := config.Conf{
+		Hosts:     map[string]string{"z.cn": "1.1.1.1"},
+		Groups:    map[string]config.Group{"fallback": {}},
+		RateLimit: config.RateLimitConf{QPS: 1, Burst: 1},
+		Views: map[string]config.ViewConf{
+			"iot":  {Clients: []string{"10.0.1.0/24"}, RateLimit: config.RateLimitConf{QPS: 1, Action: ActionDrop}},
+			"free": {Clients: []string{"10.0.2.0/24"}, RateLimit: config.RateLimitConf{QPS: -1}},
+		},
+	}
+	h, err := newHandle(conf)
+	assert.Nil(t, err)
+	refused := metricValue(t, `tsdns_rate_limited_queries_total{view="",action="refuse"}`)
+	dropped := metricValue(t, `tsdns_rate_limited_queries_total{view="iot",action="drop"}`)
+	serve := func(ip string) *dns.Msg {
+		rw := newRemoteWriter(ip)
+		h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+		return rw.Msg
+	}
+	assert.Equal(t, dns.RcodeSuccess, serve("10.0.0.1").Rcode)
+	assert.Equal(t, dns.RcodeRefused, serve("10.0.0.1").Rcode)
+	assert.NotNil(t, serve("10.0.1.1"))
+	assert.Nil(t, serve("10.0.1.1"))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, dns.RcodeSuccess, serve("10.0.2.1").Rcode)
+	}
+	assert.Equal(t, refused+1, metricValue(t, `tsdns_rate_limited_queries_total{view="",action="refuse"}`))
+	assert.Equal(t, dropped+1, metricValue(t, `tsdns_rate_limited_queries_total{view="iot",action="drop"}`))
+}
@@ -0,0 +1,221 @@
+package inbound
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+const (
+	defaultRRLWindow     = 15
+	defaultRRLSlip       = 2
+	defaultRRLIPv4Prefix = 24
+	defaultRRLIPv6Prefix = 56
+)
+
+// rrlAction 响应限速的处理结果
+type rrlAction int
+
+const (
+	rrlPass rrlAction = iota // 正常响应
+	rrlDrop                  // 丢弃响应
+	rrlSlip                  // 以TC=1的空响应代替，促使客户端改用TCP
+)
+
+func (a rrlAction) String() string {
+	switch a {
+	case rrlDrop:
+		return "drop"
+	case rrlSlip:
+		return "slip"
+	}
+	return "pass"
+}
+
+// 响应类型，不同类型使用不同的速率
+const (
+	rrlCategoryResponse = "response" // 有结果的响应
+	rrlCategoryNXDomain = "nxdomain" // NXDOMAIN/NODATA
+	rrlCategoryError    = "error"    // 其它错误
+)
+
+// responseLimiter BIND风格的响应限速（RRL），按客户端网段及响应类型统计响应速率，
+// 超出速率时丢弃响应或每slip次发送一次截断响应，用于防止UDP反射放大攻击
+type responseLimiter struct {
+	rates   map[string]float64 // category -> 每秒响应数
+	window  float64
+	slip    int
+	v4Mask  net.IPMask
+	v6Mask  net.IPMask
+	logOnly bool
+
+	lock      sync.Mutex
+	buckets   map[string]*rrlBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rrlBucket struct {
+	balance  float64
+	lastSeen time.Time
+	limited  int // 连续被限速的次数，用于计算slip
+}
+
+// newResponseLimiter 根据配置创建响应限速器，responses_per_second不为正数时返回nil（不限速）
+func newResponseLimiter(conf config.RRLConf) (*responseLimiter, error) {
+	if conf.ResponsesPerSecond <= 0 {
+		return nil, nil
+	}
+	l := &responseLimiter{
+		rates: map[string]float64{
+			rrlCategoryResponse: float64(conf.ResponsesPerSecond),
+			rrlCategoryNXDomain: float64(conf.ResponsesPerSecond),
+			rrlCategoryError:    float64(conf.ResponsesPerSecond),
+		},
+		window:  defaultRRLWindow,
+		slip:    defaultRRLSlip,
+		logOnly: conf.LogOnly,
+		buckets: map[string]*rrlBucket{},
+		now:     time.Now,
+	}
+	if conf.NXDomainsPerSecond > 0 {
+		l.rates[rrlCategoryNXDomain] = float64(conf.NXDomainsPerSecond)
+	}
+	if conf.ErrorsPerSecond > 0 {
+		l.rates[rrlCategoryError] = float64(conf.ErrorsPerSecond)
+	}
+	if conf.Window > 0 {
+		l.window = float64(conf.Window)
+	}
+	if conf.Slip != nil {
+		if *conf.Slip < 0 || *conf.Slip > 10 {
+			return nil, fmt.Errorf("invalid slip: %d", *conf.Slip)
+		}
+		l.slip = *conf.Slip
+	}
+	v4Prefix, v6Prefix := conf.IPv4Prefix, conf.IPv6Prefix
+	if v4Prefix == 0 {
+		v4Prefix = defaultRRLIPv4Prefix
+	}
+	if v6Prefix == 0 {
+		v6Prefix = defaultRRLIPv6Prefix
+	}
+	if v4Prefix < 0 || v4Prefix > 32 {
+		return nil, fmt.Errorf("invalid ipv4_prefix: %d", conf.IPv4Prefix)
+	}
+	if v6Prefix < 0 || v6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ipv6_prefix: %d", conf.IPv6Prefix)
+	}
+	l.v4Mask, l.v6Mask = net.CIDRMask(v4Prefix, 32), net.CIDRMask(v6Prefix, 128)
+	l.lastSweep = l.now()
+	return l, nil
+}
+
+// classify 返回响应类型及用于区分令牌桶的响应标识
+func classify(req, resp *dns.Msg) (category string, identity string) {
+	var name, qType string
+	if len(req.Question) > 0 {
+		name = strings.ToLower(req.Question[0].Name)
+		qType = strconv.Itoa(int(req.Question[0].Qtype))
+	}
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		return rrlCategoryResponse, name + "/" + qType
+	case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+		// NXDOMAIN/NODATA按所属域（SOA）聚合，避免随机子域名绕过限速
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return rrlCategoryNXDomain, strings.ToLower(soa.Hdr.Name)
+			}
+		}
+		return rrlCategoryNXDomain, name
+	}
+	return rrlCategoryError, ""
+}
+
+// Check 记录一次对客户端的响应并返回处理结果，log_only模式下总是返回rrlPass
+func (l *responseLimiter) Check(ip net.IP, req, resp *dns.Msg) rrlAction {
+	if ip == nil || resp == nil {
+		return rrlPass
+	}
+	var prefix string
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix = ip4.Mask(l.v4Mask).String()
+	} else {
+		prefix = ip.Mask(l.v6Mask).String()
+	}
+	category, identity := classify(req, resp)
+	key := prefix + "|" + category + "|" + identity
+	rate, now := l.rates[category], l.now()
+
+	first := false // 令牌桶本轮首次被限速
+
+	l.lock.Lock()
+	if now.Sub(l.lastSweep).Seconds() >= l.window {
+		l.sweep(now)
+	}
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &rrlBucket{balance: rate, lastSeen: now}
+		l.buckets[key] = b
+	}
+	b.balance = math.Min(rate, b.balance+now.Sub(b.lastSeen).Seconds()*rate) - 1
+	b.balance = math.Max(b.balance, -l.window*rate)
+	b.lastSeen = now
+	action := rrlPass
+	if b.balance < 0 {
+		b.limited++
+		first = b.limited == 1
+		action = rrlDrop
+		if l.slip > 0 && b.limited%l.slip == 0 {
+			action = rrlSlip
+		}
+	} else {
+		b.limited = 0
+	}
+	l.lock.Unlock()
+
+	if action == rrlPass {
+		return rrlPass
+	}
+	rrlActionCnt.Inc(action.String(), strconv.FormatBool(l.logOnly))
+	fields := logrus.Fields{"remote": ip.String(), "category": category, "identity": identity}
+	if l.logOnly {
+		// 每个令牌桶仅在开始被限速时以info级别记录一次，避免刷屏，次数通过监控指标观察
+		if first {
+			logrus.WithFields(fields).Infof("rrl would %s response", action)
+		} else {
+			logrus.WithFields(fields).Debugf("rrl would %s response", action)
+		}
+		return rrlPass
+	}
+	// 受攻击时会大量出现，仅以debug级别记录，通过监控指标观察
+	logrus.WithFields(fields).Debugf("rrl %s response", action)
+	return action
+}
+
+// sweep 清理余额已恢复且超过window未使用的令牌桶，调用方需持有锁
+func (l *responseLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen).Seconds() >= l.window {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// slipResponse 构建TC=1的空响应
+func slipResponse(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Truncated = true
+	return resp
+}
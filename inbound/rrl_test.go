@@ -0,0 +1,146 @@
+package inbound
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+func TestClassify(t *testing.T) {
+	req := buildReq("A.z.cn.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR("a.z.cn. 60 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	category, identity := classify(req, resp)
+	assert.Equal(t, rrlCategoryResponse, category)
+	assert.Equal(t, "a.z.cn./1", identity)
+
+	resp.Answer, resp.Rcode = nil, dns.RcodeNameError
+	category, identity = classify(req, resp)
+	assert.Equal(t, rrlCategoryNXDomain, category)
+	assert.Equal(t, "a.z.cn.", identity)
+	soa, _ := dns.NewRR("z.cn. 60 IN SOA ns.z.cn. admin.z.cn. 1 2 3 4 5")
+	resp.Ns = append(resp.Ns, soa)
+	_, identity = classify(req, resp)
+	assert.Equal(t, "z.cn.", identity)
+
+	resp.Rcode = dns.RcodeServerFailure
+	category, identity = classify(req, resp)
+	assert.Equal(t, rrlCategoryError, category)
+	assert.Equal(t, "", identity)
+}
+
+func TestResponseLimiter(t *testing.T) {
+	l, err := newResponseLimiter(config.RRLConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	slip := 11
+	_, err = newResponseLimiter(config.RRLConf{ResponsesPerSecond: 1, Slip: &slip})
+	assert.NotNil(t, err)
+	_, err = newResponseLimiter(config.RRLConf{ResponsesPerSecond: 1, IPv4Prefix: 33})
+	assert.NotNil(t, err)
+	_, err = newResponseLimiter(config.RRLConf{ResponsesPerSecond: 1, IPv6Prefix: 129})
+	assert.NotNil(t, err)
+
+	req := buildReq("z.cn.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR("z.cn. 60 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	nxResp := new(dns.Msg)
+	nxResp.SetRcode(req, dns.RcodeNameError)
+
+	t.Run("slip", func(t *testing.T) {
+		l, err := newResponseLimiter(config.RRLConf{ResponsesPerSecond: 2, NXDomainsPerSecond: 1})
+		assert.Nil(t, err)
+		dropped := metricValue(t, `tsdns_rrl_responses_total{action="drop",log_only="false"}`)
+		slipped := metricValue(t, `tsdns_rrl_responses_total{action="slip",log_only="false"}`)
+		now := time.Now()
+		l.now = func() time.Time { return now }
+		ip1, ip2 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1")
+		assert.Equal(t, rrlPass, l.Check(ip1, req, resp))
+		assert.Equal(t, rrlPass, l.Check(ip1, req, resp))
+		assert.Equal(t, rrlDrop, l.Check(ip1, req, resp))
+		assert.Equal(t, rrlSlip, l.Check(net.ParseIP("10.0.0.2"), req, resp)) // 同一/24网段
+		assert.Equal(t, rrlDrop, l.Check(ip1, req, resp))
+		// 不同网段、不同响应类型互不影响
+		assert.Equal(t, rrlPass, l.Check(ip2, req, resp))
+		assert.Equal(t, rrlPass, l.Check(ip1, req, nxResp))
+		assert.Equal(t, rrlDrop, l.Check(ip1, req, nxResp))
+		assert.Equal(t, dropped+3, metricValue(t, `tsdns_rrl_responses_total{action="drop",log_only="false"}`))
+		assert.Equal(t, slipped+1, metricValue(t, `tsdns_rrl_responses_total{action="slip",log_only="false"}`))
+		// 余额恢复
+		now = now.Add(3 * time.Second)
+		assert.Equal(t, rrlPass, l.Check(ip1, req, resp))
+		// 清理
+		now = now.Add(time.Minute)
+		assert.Equal(t, rrlPass, l.Check(ip2, req, resp))
+		assert.Equal(t, 1, len(l.buckets))
+	})
+	t.Run("no_slip", func(t *testing.T) {
+		slip := 0
+		l, err := newResponseLimiter(config.RRLConf{ResponsesPerSecond: 1, Slip: &slip})
+		assert.Nil(t, err)
+		ip := net.ParseIP("fd00::1")
+		assert.Equal(t, rrlPass, l.Check(ip, req, resp))
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, rrlDrop, l.Check(ip, req, resp))
+		}
+		assert.Equal(t, rrlPass, l.Check(nil, req, resp))
+	})
+	t.Run("log_only", func(t *testing.T) {
+		l, err := newResponseLimiter(config.RRLConf{ResponsesPerSecond: 1, LogOnly: true})
+		assert.Nil(t, err)
+		dropped := metricValue(t, `tsdns_rrl_responses_total{action="drop",log_only="true"}`)
+		slipped := metricValue(t, `tsdns_rrl_responses_total{action="slip",log_only="true"}`)
+		hook := logtest.NewGlobal()
+		defer logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+		ip := net.ParseIP("10.0.0.1")
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, rrlPass, l.Check(ip, req, resp))
+		}
+		// default slip is 2
+		assert.Equal(t, dropped+2, metricValue(t, `tsdns_rrl_responses_total{action="drop",log_only="true"}`))
+		assert.Equal(t, slipped+2, metricValue(t, `tsdns_rrl_responses_total{action="slip",log_only="true"}`))
+		infos := func() (count int) {
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.InfoLevel {
+					count++
+				}
+			}
+			return
+		}
+		// only the first limited response of a bucket is logged at info level
+		assert.Equal(t, 1, infos())
+		// bucket recovered, log again when limited next time
+		l.now = func() time.Time { return time.Now().Add(time.Minute) }
+		for i := 0; i < 3; i++ {
+			l.Check(ip, req, resp)
+		}
+		assert.Equal(t, 2, infos())
+	})
+}
+
+func TestHandlerRRL(t *testing.T) {
+	slip := 1
+	h, err := newHandle(config.Conf{
+		Hosts:  map[string]string{"z.cn": "1.1.1.1"},
+		Groups: map[string]config.Group{"fallback": {}},
+		RRL:    config.RRLConf{ResponsesPerSecond: 1, Slip: &slip},
+	})
+	assert.Nil(t, err)
+	rw := newRemoteWriter("10.0.0.1")
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.Equal(t, 1, len(rw.Msg.Answer))
+	rw = newRemoteWriter("10.0.0.1")
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.True(t, rw.Msg.Truncated)
+	assert.Empty(t, rw.Msg.Answer)
+}
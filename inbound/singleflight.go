@@ -0,0 +1,52 @@
+package inbound
+
+import (
+	"errors"
+	"sync"
+)
+
+// errFlightPanic 进行中的请求panic时，等待该请求结果的调用方得到的错误
+var errFlightPanic = errors.New("in-flight query panicked")
+
+// flightGroup 合并相同的并发请求，同一时刻每个key只进行一次上游解析
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg   sync.WaitGroup
+	res  resolveResult
+	dups int
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+// Do 执行fn并返回其结果，执行期间相同key的调用等待并共享该结果。shared表示结果是否被多个调用方共享
+func (g *flightGroup) Do(key string, fn func() resolveResult) (res resolveResult, shared bool) {
+	g.lock.Lock()
+	if c, exists := g.calls[key]; exists {
+		c.dups++
+		g.lock.Unlock()
+		c.wg.Wait()
+		return c.res, true
+	}
+	c := new(flightCall)
+	c.res.err = errFlightPanic // fn正常返回时被覆盖
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	// fn panic时也需唤醒等待方，panic继续向上传递
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		shared = c.dups > 0
+		g.lock.Unlock()
+		c.wg.Done()
+	}()
+	c.res = fn()
+	return c.res, shared
+}
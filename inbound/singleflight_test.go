@@ -0,0 +1,115 @@
+package inbound
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/utils"
+	"github.com/wolf-joe/ts-dns/utils/mock"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	var wg sync.WaitGroup
+	sharedCnt := int32(0)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, shared := g.Do("key", func() resolveResult {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(100 * time.Millisecond)
+				return resolveResult{resp: new(dns.Msg)}
+			})
+			assert.NotNil(t, res.resp)
+			if shared {
+				atomic.AddInt32(&sharedCnt, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, int32(5), sharedCnt)
+
+	// not shared after finished
+	_, shared := g.Do("key", func() resolveResult { return resolveResult{} })
+	assert.False(t, shared)
+
+	// leader panics, waiters get an error instead of blocking forever
+	started, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { assert.Equal(t, "boom", recover()) }()
+		g.Do("panic", func() resolveResult {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			panic("boom")
+		})
+	}()
+	<-started
+	res, shared := g.Do("panic", func() resolveResult { return resolveResult{resp: new(dns.Msg)} })
+	assert.True(t, shared)
+	assert.Nil(t, res.resp)
+	assert.Equal(t, errFlightPanic, res.err)
+	<-done
+	res, shared = g.Do("panic", func() resolveResult { return resolveResult{resp: new(dns.Msg)} })
+	assert.False(t, shared)
+	assert.NotNil(t, res.resp)
+}
+
+func TestHandlerCoalesce(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "query.log")
+	h, err := newHandle(config.Conf{
+		Groups:   map[string]config.Group{"fallback": {}},
+		QueryLog: config.QueryLogConf{File: logFile},
+	})
+	assert.Nil(t, err)
+	h.start()
+	var calls int32
+	h.views.defaultView.fallbackGroup = mock.Group{
+		MockHandle: func(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			rr, _ := dns.NewRR("a.cn. 60 IN A 1.1.1.1")
+			resp.Answer = append(resp.Answer, rr)
+			return resp, nil
+		},
+		MockPostProcess: func(req, resp *dns.Msg) {},
+		MockName:        func() string { return "fallback" },
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			req := buildReq("a.cn.", dns.TypeA)
+			req.Id = id
+			rw := utils.NewFakeRespWriter()
+			h.ServeDNS(rw, req)
+			assert.Equal(t, id, rw.Msg.Id)
+			assert.Equal(t, 1, len(rw.Msg.Answer))
+		}(uint16(1000 + i))
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+
+	// coalesced queries are marked in query log
+	h.stop()
+	content, err := os.ReadFile(logFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, strings.Count(string(content), "\n"))
+	assert.Equal(t, 4, strings.Count(string(content), `"coalesced":true`))
+}
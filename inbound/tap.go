@@ -0,0 +1,67 @@
+package inbound
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/dnstap"
+	"github.com/wolf-joe/ts-dns/outbound"
+)
+
+// clientProtocol 根据ResponseWriter判断客户端使用的协议
+func clientProtocol(writer dns.ResponseWriter) string {
+	if _, ok := writer.(*dohRespWriter); ok {
+		return config.ProtocolHTTPS
+	}
+	if cs, ok := writer.(interface{ ConnectionState() *tls.ConnectionState }); ok && cs.ConnectionState() != nil {
+		return config.ProtocolTLS
+	}
+	if _, ok := writer.RemoteAddr().(*net.UDPAddr); ok {
+		return config.ProtocolUDP
+	}
+	return config.ProtocolTCP
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// tapClient 记录客户端的请求，resp不为nil时记录响应
+func (h *handlerImpl) tapClient(writer dns.ResponseWriter, begin time.Time, req, resp *dns.Msg) {
+	msg := &dnstap.Message{
+		Type:         dnstap.ClientQuery,
+		Protocol:     clientProtocol(writer),
+		QueryAddr:    addrString(writer.RemoteAddr()),
+		ResponseAddr: addrString(writer.LocalAddr()),
+		QueryTime:    begin,
+		Query:        req,
+	}
+	if resp != nil {
+		msg.Type, msg.ResponseTime, msg.Response = dnstap.ClientResponse, time.Now(), resp
+	}
+	h.tap.Write(msg)
+}
+
+// tapForwarder 记录转发至上游的请求及成功时的响应
+func (h *handlerImpl) tapForwarder(_ context.Context, _ string, caller outbound.Caller, req, resp *dns.Msg,
+	begin time.Time, err error) {
+	msg := &dnstap.Message{
+		Type:         dnstap.ForwarderQuery,
+		Protocol:     caller.Protocol(),
+		ResponseAddr: caller.Address(),
+		QueryTime:    begin,
+		Query:        req,
+	}
+	h.tap.Write(msg)
+	if err == nil && resp != nil {
+		msg.Type, msg.ResponseTime, msg.Response = dnstap.ForwarderResponse, time.Now(), resp
+		h.tap.Write(msg)
+	}
+}
@@ -0,0 +1,40 @@
+package inbound
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// CertHolder 保存可热重载的TLS证书，重载后新建立的连接使用新证书
+type CertHolder struct {
+	certPtr unsafe.Pointer // type: *tls.Certificate
+}
+
+// Load 读取证书及私钥文件，成功时替换当前证书
+func (c *CertHolder) Load(certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("tls_cert and tls_key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load x509 key pair (%q, %q) failed: %w", certFile, keyFile, err)
+	}
+	atomic.StorePointer(&c.certPtr, unsafe.Pointer(&cert))
+	return nil
+}
+
+// TLSConfig 返回一个总是使用当前证书的tls.Config
+func (c *CertHolder) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.getCertificate}
+}
+
+func (c *CertHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ptr := atomic.LoadPointer(&c.certPtr)
+	if ptr == nil {
+		return nil, errors.New("certificate not loaded")
+	}
+	return (*tls.Certificate)(ptr), nil
+}
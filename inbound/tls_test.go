@@ -0,0 +1,65 @@
+package inbound
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert 在dir下生成自签名证书，返回证书及私钥文件路径
+func writeCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestCertHolder(t *testing.T) {
+	dir := t.TempDir()
+	holder := new(CertHolder)
+	conf := holder.TLSConfig()
+	_, err := conf.GetCertificate(nil)
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, holder.Load("", ""))
+	assert.NotNil(t, holder.Load("not_exists.crt", "not_exists.key"))
+
+	certFile, keyFile := writeCert(t, dir, "a.test")
+	assert.Nil(t, holder.Load(certFile, keyFile))
+	cert, err := conf.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "a.test", leaf.Subject.CommonName)
+
+	// reload
+	certFile, keyFile = writeCert(t, dir, "b.test")
+	assert.Nil(t, holder.Load(certFile, keyFile))
+	cert, err = conf.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "b.test", leaf.Subject.CommonName)
+}
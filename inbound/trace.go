@@ -0,0 +1,76 @@
+package inbound
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/utils"
+)
+
+// defaultTraceCapacity 默认保留的请求时间线数量
+const defaultTraceCapacity = 100
+
+// logIDSeq 用于为每个请求分配log id，相邻请求的log id不同
+var logIDSeq uint32
+
+func nextLogID() uint16 {
+	return uint16(atomic.AddUint32(&logIDSeq, 1))
+}
+
+// traceRecorder 保留最近的请求时间线
+type traceRecorder struct {
+	lock      sync.Mutex
+	threshold time.Duration
+	traces    []*utils.Trace // 环形缓冲区
+	next      int
+	full      bool
+}
+
+// newTraceRecorder 创建时间线记录器，未启用时返回nil
+func newTraceRecorder(conf config.TraceConf) (*traceRecorder, error) {
+	if !conf.Enable {
+		return nil, nil
+	}
+	if conf.SlowThreshold < 0 || conf.Capacity < 0 {
+		return nil, fmt.Errorf("invalid slow_threshold/capacity: %d/%d", conf.SlowThreshold, conf.Capacity)
+	}
+	capacity := conf.Capacity
+	if capacity == 0 {
+		capacity = defaultTraceCapacity
+	}
+	return &traceRecorder{
+		threshold: time.Duration(conf.SlowThreshold) * time.Millisecond,
+		traces:    make([]*utils.Trace, capacity),
+	}, nil
+}
+
+// add 结束时间线，耗时不低于阈值时保留
+func (r *traceRecorder) add(trace *utils.Trace) {
+	if trace.Finish() < r.threshold {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.traces[r.next] = trace
+	if r.next = (r.next + 1) % len(r.traces); r.next == 0 {
+		r.full = true
+	}
+}
+
+// list 按从新到旧的顺序返回保留的时间线
+func (r *traceRecorder) list() []*utils.Trace {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.traces)
+	}
+	traces := make([]*utils.Trace, 0, count)
+	for i := 1; i <= count; i++ {
+		traces = append(traces, r.traces[(r.next-i+len(r.traces))%len(r.traces)])
+	}
+	return traces
+}
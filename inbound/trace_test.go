@@ -0,0 +1,75 @@
+package inbound
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/utils"
+	"github.com/wolf-joe/ts-dns/utils/mock"
+)
+
+func TestTraceRecorder(t *testing.T) {
+	r, err := newTraceRecorder(config.TraceConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+	_, err = newTraceRecorder(config.TraceConf{Enable: true, Capacity: -1})
+	assert.NotNil(t, err)
+
+	r, err = newTraceRecorder(config.TraceConf{Enable: true, Capacity: 2})
+	assert.Nil(t, err)
+	req := buildReq("z.cn", dns.TypeA)
+	for id := uint16(1); id <= 3; id++ {
+		r.add(utils.NewTrace(id, "", req))
+	}
+	traces := r.list()
+	assert.Equal(t, 2, len(traces))
+	assert.Equal(t, "0x0003", traces[0].ID())
+	assert.Equal(t, "0x0002", traces[1].ID())
+
+	// only slow queries
+	r, _ = newTraceRecorder(config.TraceConf{Enable: true, SlowThreshold: 50})
+	r.add(utils.NewTrace(1, "", req))
+	slow := utils.NewTrace(2, "", req)
+	time.Sleep(50 * time.Millisecond)
+	r.add(slow)
+	traces = r.list()
+	assert.Equal(t, 1, len(traces))
+	assert.Equal(t, "0x0002", traces[0].ID())
+}
+
+func TestHandlerTrace(t *testing.T) {
+	h, err := NewHandler(config.Conf{
+		Groups: map[string]config.Group{"fallback": {}},
+		Trace:  config.TraceConf{Enable: true},
+	})
+	assert.Nil(t, err)
+	defer h.Stop()
+	impl := (*handlerImpl)(h.(*handlerWrapper).handlerPtr)
+	impl.views.defaultView.fallbackGroup = mock.Group{
+		MockHandle: func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+			utils.CtxDebug(ctx, "call upstream")
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			return resp, nil
+		},
+		MockPostProcess: func(req, resp *dns.Msg) {},
+		MockName:        func() string { return "fallback" },
+	}
+	h.ServeDNS(utils.NewFakeRespWriter(), buildReq("z.cn", dns.TypeA))
+
+	traces := h.Traces()
+	assert.Equal(t, 1, len(traces))
+	data, err := traces[0].MarshalJSON()
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"question":"z.cn"`)
+	assert.Contains(t, string(data), `match group \"fallback\"`)
+	assert.Contains(t, string(data), "call upstream")
+
+	// keep traces after reload
+	assert.Nil(t, h.ReloadConfig(h.Config()))
+	assert.Equal(t, 1, len(h.Traces()))
+}
@@ -0,0 +1,150 @@
+package inbound
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/yl2chen/cidranger"
+)
+
+// view 按客户端地址区分的解析策略，默认视图的name为空
+type view struct {
+	name          string
+	disableQTypes map[uint16]bool
+	hosts         hosts.IDNSHosts
+	groups        *outbound.Groups
+	fallbackGroup outbound.IGroup
+	limiter       *rateLimiter // 为nil时不限速
+}
+
+func (v *view) String() string {
+	if v.name == "" {
+		return "view_default"
+	}
+	return "view_" + v.name
+}
+
+// viewEntry 将客户端网段关联到视图
+type viewEntry struct {
+	ipNet net.IPNet
+	view  *view
+}
+
+func (e *viewEntry) Network() net.IPNet { return e.ipNet }
+
+// viewSelector 按客户端地址选择视图，多个网段匹配时使用掩码最长的网段
+type viewSelector struct {
+	ranger      cidranger.Ranger
+	defaultView *view
+	byName      map[string]*view
+}
+
+// Get 按名称查找视图，名称为空时返回默认视图
+func (s *viewSelector) Get(name string) *view {
+	if name == "" {
+		return s.defaultView
+	}
+	return s.byName[name]
+}
+
+func (s *viewSelector) Select(ip net.IP) *view {
+	if s.ranger == nil || ip == nil {
+		return s.defaultView
+	}
+	entries, err := s.ranger.ContainingNetworks(ip)
+	if err != nil || len(entries) == 0 {
+		return s.defaultView
+	}
+	best, bestOnes := s.defaultView, -1
+	for _, entry := range entries {
+		ipNet := entry.Network()
+		if ones, _ := ipNet.Mask.Size(); ones > bestOnes {
+			best, bestOnes = entry.(*viewEntry).view, ones
+		}
+	}
+	return best
+}
+
+func parseQTypes(disableIPv6 bool, qTypes []string) (map[uint16]bool, error) {
+	res := map[uint16]bool{}
+	if disableIPv6 {
+		res[dns.TypeAAAA] = true
+	}
+	for _, qTypeStr := range qTypes {
+		qTypeStr = strings.ToUpper(qTypeStr)
+		if _, exists := dns.StringToType[qTypeStr]; !exists {
+			return nil, fmt.Errorf("unknown query type: %q", qTypeStr)
+		}
+		res[dns.StringToType[qTypeStr]] = true
+	}
+	return res, nil
+}
+
+// newViewSelector 根据全局配置构建默认视图，并根据views配置构建各客户端视图
+func newViewSelector(conf config.Conf, defaultView *view, groups *outbound.Groups) (*viewSelector, error) {
+	s := &viewSelector{defaultView: defaultView, byName: map[string]*view{}}
+	if len(conf.Views) == 0 {
+		return s, nil
+	}
+	s.ranger = cidranger.NewPCTrieRanger()
+	seen := map[string]string{} // cidr -> view name
+	for name, vc := range conf.Views {
+		if name == "" {
+			return nil, fmt.Errorf("view name should not be empty")
+		}
+		v := &view{
+			name:          name,
+			disableQTypes: defaultView.disableQTypes,
+			hosts:         defaultView.hosts,
+			limiter:       defaultView.limiter,
+		}
+		var err error
+		if vc.RateLimit.QPS < 0 {
+			v.limiter = nil
+		} else if vc.RateLimit.QPS > 0 {
+			if v.limiter, err = newRateLimiter(vc.RateLimit); err != nil {
+				return nil, fmt.Errorf("build rate limiter for view %q failed: %w", name, err)
+			}
+		}
+		if vc.DisableIPv6 || len(vc.DisableQTypes) > 0 {
+			if v.disableQTypes, err = parseQTypes(vc.DisableIPv6, vc.DisableQTypes); err != nil {
+				return nil, fmt.Errorf("build view %q failed: %w", name, err)
+			}
+		}
+		if len(vc.Hosts) > 0 || len(vc.HostsFiles) > 0 {
+			hostsConf := config.Conf{Hosts: vc.Hosts, HostsFiles: vc.HostsFiles}
+			if v.hosts, err = hosts.NewDNSHosts(hostsConf); err != nil {
+				return nil, fmt.Errorf("build hosts for view %q failed: %w", name, err)
+			}
+		}
+		if v.groups, err = groups.Subset(vc.Groups, vc.Fallback); err != nil {
+			return nil, fmt.Errorf("build groups for view %q failed: %w", name, err)
+		}
+		if v.fallbackGroup = v.groups.Fallback(); v.fallbackGroup == nil {
+			return nil, fmt.Errorf("fallback group not found for view %q", name)
+		}
+		s.byName[name] = v
+		if len(vc.Clients) == 0 {
+			return nil, fmt.Errorf("empty clients for view %q", name)
+		}
+		for _, cidr := range vc.Clients {
+			ipNet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("build view %q failed: %w", name, err)
+			}
+			if other, exists := seen[ipNet.String()]; exists {
+				return nil, fmt.Errorf("cidr %s used by both view %q and %q", ipNet, other, name)
+			}
+			seen[ipNet.String()] = name
+			if err = s.ranger.Insert(&viewEntry{ipNet: *ipNet, view: v}); err != nil {
+				return nil, fmt.Errorf("add cidr %s for view %q failed: %w", ipNet, name, err)
+			}
+		}
+	}
+	return s, nil
+}
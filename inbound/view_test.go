@@ -0,0 +1,130 @@
+package inbound
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/utils"
+)
+
+// remoteRespWriter 可指定客户端地址的FakeRespWriter
+type remoteRespWriter struct {
+	*utils.FakeRespWriter
+	remote net.Addr
+}
+
+func (w remoteRespWriter) RemoteAddr() net.Addr { return w.remote }
+
+func newRemoteWriter(ip string) remoteRespWriter {
+	return remoteRespWriter{
+		FakeRespWriter: utils.NewFakeRespWriter(),
+		remote:         &net.UDPAddr{IP: net.ParseIP(ip), Port: 53},
+	}
+}
+
+func TestViews(t *testing.T) {
+	conf := config.Conf{
+		Hosts: map[string]string{"z.cn": "1.1.1.1"},
+		Cache: config.CacheConf{Size: 10},
+		Groups: map[string]config.Group{
+			"clean":  {Fallback: true},
+			"work":   {Rules: []string{"company.com"}},
+			"filter": {Rules: []string{"company.com"}},
+		},
+		Views: map[string]config.ViewConf{
+			"kids": {
+				Clients:       []string{"192.168.2.0/24"},
+				Groups:        []string{"filter"},
+				Fallback:      "filter",
+				Hosts:         map[string]string{"z.cn": "2.2.2.2"},
+				DisableQTypes: []string{"AAAA"},
+			},
+			"work": {
+				Clients: []string{"192.168.0.0/16"},
+				Groups:  []string{"work", "filter"},
+			},
+		},
+	}
+	h, err := newHandle(conf)
+	assert.Nil(t, err)
+	var srcGroup outbound.IGroup
+	h.redirector = func(_ context.Context, src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup {
+		srcGroup = src
+		return nil
+	}
+
+	// default view
+	assert.Equal(t, "", h.views.Select(net.ParseIP("10.0.0.1")).name)
+	assert.Equal(t, "", h.views.Select(nil).name)
+	assert.Equal(t, "kids", h.views.Get("kids").name)
+	assert.Equal(t, "", h.views.Get("").name)
+	assert.Nil(t, h.views.Get("unknown"))
+	rw := newRemoteWriter("10.0.0.1")
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.Equal(t, "1.1.1.1", rw.Msg.Answer[0].(*dns.A).A.String())
+	h.ServeDNS(newRemoteWriter("10.0.0.1"), buildReq("company.com.", dns.TypeA))
+	assert.Equal(t, "filter", srcGroup.Name()) // 按组名排序
+	h.ServeDNS(newRemoteWriter("10.0.0.1"), buildReq("qq.com.", dns.TypeA))
+	assert.Equal(t, "clean", srcGroup.Name())
+
+	// work view: group list order
+	assert.Equal(t, "work", h.views.Select(net.ParseIP("192.168.1.1")).name)
+	h.ServeDNS(newRemoteWriter("192.168.1.1"), buildReq("company.com.", dns.TypeA))
+	assert.Equal(t, "work", srcGroup.Name())
+	h.ServeDNS(newRemoteWriter("192.168.1.1"), buildReq("qq.com.", dns.TypeA))
+	assert.Equal(t, "clean", srcGroup.Name())
+
+	// kids view: longest prefix, own hosts/fallback/disable_qtypes
+	assert.Equal(t, "kids", h.views.Select(net.ParseIP("192.168.2.1")).name)
+	rw = newRemoteWriter("192.168.2.1")
+	h.ServeDNS(rw, buildReq("z.cn", dns.TypeA))
+	assert.Equal(t, "2.2.2.2", rw.Msg.Answer[0].(*dns.A).A.String())
+	h.ServeDNS(newRemoteWriter("192.168.2.1"), buildReq("qq.com.", dns.TypeA))
+	assert.Equal(t, "filter", srcGroup.Name())
+	srcGroup = nil
+	rw = newRemoteWriter("192.168.2.1")
+	h.ServeDNS(rw, buildReq("qq.com.", dns.TypeAAAA))
+	assert.Nil(t, srcGroup)
+	assert.Empty(t, rw.Msg.Answer)
+
+	// cache isolated by view
+	rr, _ := dns.NewRR("qq.com. 60 IN A 3.3.3.3")
+	h.cache.Set("kids", "", buildReq("qq.com.", dns.TypeA), &dns.Msg{Answer: []dns.RR{rr}})
+	rw = newRemoteWriter("192.168.2.1")
+	h.ServeDNS(rw, buildReq("qq.com.", dns.TypeA))
+	assert.Equal(t, 1, len(rw.Msg.Answer))
+	rw = newRemoteWriter("10.0.0.1")
+	h.ServeDNS(rw, buildReq("qq.com.", dns.TypeA))
+	assert.Empty(t, rw.Msg.Answer)
+}
+
+func TestNewViewSelector(t *testing.T) {
+	base := config.Conf{Groups: map[string]config.Group{"clean": {}}}
+	cases := map[string]config.ViewConf{
+		"unknown_group":    {Clients: []string{"1.1.1.1"}, Groups: []string{"dirty"}},
+		"unknown_fallback": {Clients: []string{"1.1.1.1"}, Fallback: "dirty"},
+		"empty_clients":    {},
+		"wrong_clients":    {Clients: []string{"1.1.1.1/33"}},
+		"wrong_qtypes":     {Clients: []string{"1.1.1.1"}, DisableQTypes: []string{"???"}},
+		"wrong_hosts":      {Clients: []string{"1.1.1.1"}, HostsFiles: []string{"not_exists.txt"}},
+	}
+	for name, vc := range cases {
+		conf := base
+		conf.Views = map[string]config.ViewConf{name: vc}
+		_, err := newHandle(conf)
+		assert.NotNil(t, err, name)
+	}
+	conf := base
+	conf.Views = map[string]config.ViewConf{
+		"a": {Clients: []string{"1.1.1.0/24"}},
+		"b": {Clients: []string{"1.1.1.0/24"}},
+	}
+	_, err := newHandle(conf)
+	assert.NotNil(t, err)
+	t.Log(err)
+}
@@ -0,0 +1,289 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 以Prometheus文本格式输出监控指标，参考 https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// ContentType Prometheus文本格式的Content-Type
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets 默认的直方图分桶，单位为秒
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Collector 一个指标，由CounterVec等类型实现
+type Collector interface {
+	name() string
+	collect(buf *bytes.Buffer)
+}
+
+// Registry 指标集合
+type Registry struct {
+	lock       sync.Mutex
+	collectors []Collector
+	names      map[string]bool
+}
+
+// NewRegistry 创建空的指标集合
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// Default 各模块注册运行时指标的默认集合，指标在配置重载后继续累计
+var Default = NewRegistry()
+
+// MustRegister 注册指标，指标名重复时panic
+func (r *Registry) MustRegister(cs ...Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, c := range cs {
+		if r.names[c.name()] {
+			panic(fmt.Sprintf("metric %q already registered", c.name()))
+		}
+		r.names[c.name()] = true
+		r.collectors = append(r.collectors, c)
+	}
+}
+
+// WriteTo 按注册顺序输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.lock.Unlock()
+	buf := new(bytes.Buffer)
+	for _, c := range collectors {
+		c.collect(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// desc 指标名、说明、类型及标签名
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) header(buf *bytes.Buffer) {
+	buf.WriteString("# HELP " + d.fqName + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help) + "\n")
+	buf.WriteString("# TYPE " + d.fqName + " " + d.typ + "\n")
+}
+
+// sample 输出一个样本，extra为附加的标签（如直方图的le）
+func (d *desc) sample(buf *bytes.Buffer, suffix string, values []string, extra []string, val float64) {
+	buf.WriteString(d.fqName + suffix)
+	if len(d.labels)+len(extra) > 0 {
+		buf.WriteByte('{')
+		for i, label := range d.labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(label + `="` + escapeLabel(values[i]) + `"`)
+		}
+		// extra以name, value成对出现
+		for i := 0; i < len(extra); i += 2 {
+			if len(d.labels) > 0 || i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(extra[i] + `="` + escapeLabel(extra[i+1]) + `"`)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString(" " + formatFloat(val) + "\n")
+}
+
+// key 将标签值拼接为map的key，标签值数量与标签名不一致时panic
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %q expects %d label values, got %d", d.fqName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+func formatFloat(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// valueVec counter及gauge共用的实现
+type valueVec struct {
+	desc
+	lock   sync.Mutex
+	labels map[string][]string
+	values map[string]float64
+}
+
+func newValueVec(name, help, typ string, labels []string) valueVec {
+	return valueVec{
+		desc:   desc{fqName: name, help: help, typ: typ, labels: labels},
+		labels: map[string][]string{},
+		values: map[string]float64{},
+	}
+}
+
+func (v *valueVec) update(values []string, fn func(old float64) float64) {
+	key := v.key(values)
+	v.lock.Lock()
+	if _, exists := v.labels[key]; !exists {
+		v.labels[key] = append([]string(nil), values...)
+	}
+	v.values[key] = fn(v.values[key])
+	v.lock.Unlock()
+}
+
+func (v *valueVec) collect(buf *bytes.Buffer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.header(buf)
+	for _, key := range sortedKeys(v.labels) {
+		v.sample(buf, "", v.labels[key], nil, v.values[key])
+	}
+}
+
+// CounterVec 只增不减的计数器，按标签值区分
+type CounterVec struct{ valueVec }
+
+// NewCounterVec 创建计数器，指标名建议以_total结尾
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newValueVec(name, help, "counter", labels)}
+}
+
+// Inc 计数加一
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+// Add 计数增加delta，delta为负数时忽略
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	c.update(values, func(old float64) float64 { return old + delta })
+}
+
+// GaugeVec 可任意设置的数值，按标签值区分
+type GaugeVec struct{ valueVec }
+
+// NewGaugeVec 创建gauge
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newValueVec(name, help, "gauge", labels)}
+}
+
+// Set 设置数值
+func (g *GaugeVec) Set(val float64, values ...string) {
+	g.update(values, func(float64) float64 { return val })
+}
+
+// HistogramVec 按分桶统计观测值的分布，按标签值区分
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	labels  map[string][]string
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 各分桶的计数（非累计）
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec 创建直方图，buckets需升序排列，为空时使用DefBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	return &HistogramVec{
+		desc:    desc{fqName: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		labels:  map[string][]string{},
+		series:  map[string]*histogram{},
+	}
+}
+
+// Observe 记录一个观测值
+func (h *HistogramVec) Observe(val float64, values ...string) {
+	key := h.key(values)
+	idx := sort.SearchFloat64s(h.buckets, val) // 第一个不小于val的分桶
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.labels[key] = append([]string(nil), values...)
+	}
+	if idx < len(h.buckets) {
+		s.counts[idx]++
+	}
+	s.count++
+	s.sum += val
+}
+
+func (h *HistogramVec) collect(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.header(buf)
+	for _, key := range sortedKeys(h.labels) {
+		s, values := h.series[key], h.labels[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			h.sample(buf, "_bucket", values, []string{"le", formatFloat(bound)}, float64(cumulative))
+		}
+		h.sample(buf, "_bucket", values, []string{"le", "+Inf"}, float64(s.count))
+		h.sample(buf, "_sum", values, nil, s.sum)
+		h.sample(buf, "_count", values, nil, float64(s.count))
+	}
+}
+
+// funcMetric 在输出时通过回调获取数值的无标签指标
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+func (f *funcMetric) collect(buf *bytes.Buffer) {
+	f.header(buf)
+	f.sample(buf, "", nil, nil, f.fn())
+}
+
+// NewCounterFunc 创建在输出时通过fn获取数值的计数器，fn的返回值需单调递增
+func NewCounterFunc(name, help string, fn func() float64) Collector {
+	return &funcMetric{desc: desc{fqName: name, help: help, typ: "counter"}, fn: fn}
+}
+
+// NewGaugeFunc 创建在输出时通过fn获取数值的gauge
+func NewGaugeFunc(name, help string, fn func() float64) Collector {
+	return &funcMetric{desc: desc{fqName: name, help: help, typ: "gauge"}, fn: fn}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Requests.\nSecond line", "group", "rcode")
+	counter.Inc("b", "NOERROR")
+	counter.Add(2, "a", "SERV\"FAIL")
+	counter.Add(-1, "a", "SERV\"FAIL") // ignored
+	gauge := NewGaugeVec("test_updated", "Last update.", "group")
+	gauge.Set(10, "a")
+	gauge.Set(5, "a")
+	hist := NewHistogramVec("test_duration_seconds", "Duration.", []float64{0.1, 1})
+	hist.Observe(0.05)
+	hist.Observe(0.5)
+	hist.Observe(3)
+	size := 3
+	r := NewRegistry()
+	r.MustRegister(counter, gauge, hist, NewGaugeFunc("test_size", "Size.", func() float64 { return float64(size) }))
+	assert.Panics(t, func() { r.MustRegister(NewCounterVec("test_size", "dup")) })
+	assert.Panics(t, func() { counter.Inc("a") })
+
+	buf := new(bytes.Buffer)
+	_, err := r.WriteTo(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP test_requests_total Requests.\nSecond line
+# TYPE test_requests_total counter
+test_requests_total{group="a",rcode="SERV\"FAIL"} 2
+test_requests_total{group="b",rcode="NOERROR"} 1
+# HELP test_updated Last update.
+# TYPE test_updated gauge
+test_updated{group="a"} 5
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 3.55
+test_duration_seconds_count 3
+# HELP test_size Size.
+# TYPE test_size gauge
+test_size 3
+`, buf.String())
+}
@@ -7,7 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/config"
 	"github.com/wolf-joe/ts-dns/utils"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -23,10 +25,15 @@ import (
 
 // Caller 上游DNS请求基类
 type Caller interface {
-	Call(request *dns.Msg) (r *dns.Msg, err error)
+	// Call 向上游发送请求，ctx被取消或超时后尽快返回
+	Call(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error)
 	Start(resolver dns.Handler)
 	Exit()
 	String() string
+	// Protocol 上游协议：udp/tcp/tls/https
+	Protocol() string
+	// Address 上游服务器地址（ip:port），DoH为解析得到的首个IP，未解析时为域名:端口
+	Address() string
 }
 
 var (
@@ -45,9 +52,18 @@ type DNSCaller struct {
 func (caller *DNSCaller) Start(_ dns.Handler) {}
 
 // Call 向目标上游DNS转发请求
-func (caller *DNSCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+func (caller *DNSCaller) Call(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
 	if caller.proxy == nil { // 不使用代理，直接发送dns请求
-		r, _, err = caller.client.Exchange(request, caller.server)
+		var conn *dns.Conn
+		if conn, err = caller.client.DialContext(ctx, caller.server); err != nil {
+			return nil, err
+		}
+		defer func() { _ = conn.Close() }()
+		// ExchangeContext仅使用ctx的deadline，需在ctx取消时主动关闭连接以中断读写
+		defer closeOnDone(ctx, conn)()
+		if r, _, err = caller.client.ExchangeWithConn(request, conn); err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return
 	}
 	// 通过代理连接代理服务器
@@ -56,6 +72,10 @@ func (caller *DNSCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
 		return nil, err
 	}
 	defer func() { _ = proxyConn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = proxyConn.SetDeadline(deadline)
+	}
+	defer closeOnDone(ctx, proxyConn)()
 	// 打包连接
 	caller.conn.Conn = proxyConn
 	if caller.client.TLSConfig != nil { // dns over tls
@@ -68,6 +88,19 @@ func (caller *DNSCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
 	return caller.conn.ReadMsg()
 }
 
+// closeOnDone ctx结束时关闭连接，中断阻塞中的读写。返回的函数用于在请求完成后停止监听
+func closeOnDone(ctx context.Context, conn io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
 // Exit caller退出时行为
 func (caller *DNSCaller) Exit() {}
 
@@ -76,6 +109,18 @@ func (caller *DNSCaller) String() string {
 	return fmt.Sprintf("DNSCaller<%s/%s>", caller.server, caller.client.Net)
 }
 
+func (caller *DNSCaller) Protocol() string {
+	switch caller.client.Net {
+	case "tcp-tls":
+		return config.ProtocolTLS
+	case "tcp":
+		return config.ProtocolTCP
+	}
+	return config.ProtocolUDP
+}
+
+func (caller *DNSCaller) Address() string { return caller.server }
+
 // NewDNSCaller 创建一个UDP/TCP Caller，需要服务器地址（ip+端口）、网络类型（udp、tcp），可选代理
 func NewDNSCaller(server, network string, proxy proxy.Dialer) *DNSCaller {
 	client := &dns.Client{Net: network}
@@ -94,6 +139,7 @@ type DoHCallerV2 struct {
 	port     string
 	url      string
 	clients  []*http.Client
+	ips      []string // 与clients一一对应
 	rwMux    sync.RWMutex
 	resolver dns.Handler
 	dialer   proxy.Dialer
@@ -151,7 +197,7 @@ func (caller *DoHCallerV2) resolve(srcReq *dns.Msg, timeout time.Duration) {
 		MsgHdr:   dns.MsgHdr{Id: 0xffff, RecursionDesired: true, AuthenticatedData: true},
 		Question: []dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}},
 	}
-	writer := utils.NewFakeRespWriter()
+	writer := utils.NewInternalRespWriter()
 	done := make(chan interface{}, 1)
 	go func() {
 		if caller.resolver != nil {
@@ -177,7 +223,7 @@ func (caller *DoHCallerV2) resolve(srcReq *dns.Msg, timeout time.Duration) {
 		}
 	}
 	if len(clients) > 0 {
-		caller.clients = clients
+		caller.clients, caller.ips = clients, ips
 		logrus.Debugf("%s resolve ip %s", caller, ips)
 	} else {
 		logrus.Warnf("%s resolve ip failed", caller)
@@ -204,7 +250,7 @@ CHOICE:
 }
 
 // Call 向上游DNS转发请求
-func (caller *DoHCallerV2) Call(request *dns.Msg) (r *dns.Msg, err error) {
+func (caller *DoHCallerV2) Call(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
 	client := caller.getClient(request)
 	if client == nil {
 		return nil, errors.New("empty client for doh caller")
@@ -220,6 +266,7 @@ func (caller *DoHCallerV2) Call(request *dns.Msg) (r *dns.Msg, err error) {
 	if req, err = http.NewRequest("POST", caller.url, payload); err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", contentType)
 	// 发送http请求
 	var resp *http.Response
@@ -252,6 +299,17 @@ func (caller *DoHCallerV2) String() string {
 	return fmt.Sprintf("DoHCallerV2<%s>", caller.url)
 }
 
+func (caller *DoHCallerV2) Protocol() string { return config.ProtocolHTTPS }
+
+func (caller *DoHCallerV2) Address() string {
+	caller.rwMux.RLock()
+	defer caller.rwMux.RUnlock()
+	if len(caller.ips) > 0 {
+		return net.JoinHostPort(caller.ips[0], caller.port)
+	}
+	return net.JoinHostPort(caller.host, caller.port)
+}
+
 // SetResolver 为DoHCaller设置域名解析器，需要在用NewDoHCallerV2()成功后调用一次
 func (caller *DoHCallerV2) SetResolver(resolver dns.Handler) {
 	caller.resolver = resolver
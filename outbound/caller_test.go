@@ -1,6 +1,7 @@
 package outbound
 
 import (
+	"context"
 	"fmt"
 	"github.com/wolf-joe/ts-dns/utils/mock"
 	"io/ioutil"
@@ -36,21 +37,46 @@ func MockMethodSeq(target interface{}, methodName string, outputs []gomonkey.Par
 	return gomonkey.ApplyMethodSeq(reflect.TypeOf(target), methodName, cells)
 }
 
+// 启动本地UDP DNS服务器，返回监听地址
+func startUDPServer(t *testing.T, handler dns.HandlerFunc) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
 func TestDNSCaller(t *testing.T) {
-	req := &dns.Msg{}
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
 
-	caller := NewDNSCaller("", "", nil)
-	// 不使用代理，mock掉Exchange
-	p := MockMethodSeq(caller.client, "Exchange", []gomonkey.Params{
-		{nil, time.Second, fmt.Errorf("err")},
-		{&dns.Msg{}, time.Second, nil},
+	// 不使用代理，直接请求本地服务器
+	addr := startUDPServer(t, wrapperHandler(func(req *dns.Msg) *dns.Msg { return new(dns.Msg) }))
+	caller := NewDNSCaller(addr, "udp", nil)
+	r, err := caller.Call(context.Background(), req)
+	assertSuccess(t, r, err)
+	// 连接失败
+	caller = NewDNSCaller("127.0.0.1:0", "tcp", nil)
+	r, err = caller.Call(context.Background(), req)
+	assertFail(t, r, err)
+
+	// 上游响应缓慢时，ctx取消后应立即返回
+	slowDone := make(chan struct{})
+	defer close(slowDone)
+	addr = startUDPServer(t, func(writer dns.ResponseWriter, req *dns.Msg) {
+		<-slowDone
 	})
-	// exchange调用失败
-	r, err := caller.Call(req)
+	caller = NewDNSCaller(addr, "udp", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	begin := time.Now()
+	r, err = caller.Call(ctx, req)
 	assertFail(t, r, err)
-	// exchange调用成功
-	r, err = caller.Call(req)
-	assertSuccess(t, r, err)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(begin) < time.Second)
 
 	caller.Exit()
 	_ = caller.String()
@@ -67,18 +93,18 @@ func TestDNSCaller(t *testing.T) {
 	p3 := MockMethodSeq(caller.conn, "ReadMsg", []gomonkey.Params{
 		{nil, fmt.Errorf("err")}, {&dns.Msg{}, nil},
 	})
-	defer func() { p.Reset(); p1.Reset(); p2.Reset(); p3.Reset() }()
+	defer func() { p1.Reset(); p2.Reset(); p3.Reset() }()
 	// Dial失败
-	r, err = caller.Call(req)
+	r, err = caller.Call(context.Background(), req)
 	assertFail(t, r, err)
 	// Dial成功，但WriteMsg失败
-	r, err = caller.Call(req)
+	r, err = caller.Call(context.Background(), req)
 	assertFail(t, r, err)
 	// Dial、WriteMsg成功，但ReadMsg失败
-	r, err = caller.Call(req)
+	r, err = caller.Call(context.Background(), req)
 	assertFail(t, r, err)
 	// Dial、WriteMsg、ReadMsg都成功
-	r, err = caller.Call(req)
+	r, err = caller.Call(context.Background(), req)
 	assertSuccess(t, r, err)
 
 	caller.Exit()
@@ -135,7 +161,7 @@ func TestDoHCallerV2(t *testing.T) {
 	caller, err = NewDoHCallerV2(url, nil)
 	assert.Nil(t, err)
 	caller.Start(resolver)
-	_, err = caller.Call(req)
+	_, err = caller.Call(context.Background(), req)
 	assert.NotNil(t, err) // timeout
 	caller.Exit()
 
@@ -147,7 +173,7 @@ func TestDoHCallerV2(t *testing.T) {
 	caller, err = NewDoHCallerV2(url, nil)
 	assert.Nil(t, err)
 	caller.Start(resolver)
-	_, err = caller.Call(recReq)
+	_, err = caller.Call(context.Background(), recReq)
 	assert.NotNil(t, err) // timeout
 	caller.Exit()
 
@@ -182,23 +208,23 @@ func TestDoHCallerV2(t *testing.T) {
 	assert.Nil(t, err)
 	caller.Start(resolver)
 	// Pack失败
-	_, err = caller.Call(req)
+	_, err = caller.Call(context.Background(), req)
 	assert.NotNil(t, err)
 	// Pack成功，但NewRequest失败
-	_, err = caller.Call(req)
+	_, err = caller.Call(context.Background(), req)
 	assert.NotNil(t, err)
 	// Pack、NewRequest成功，但Do失败
-	_, err = caller.Call(req)
+	_, err = caller.Call(context.Background(), req)
 	assert.NotNil(t, err)
 	// Pack、NewRequest、Do成功，但ReadAll失败
-	_, err = caller.Call(req)
+	_, err = caller.Call(context.Background(), req)
 	assert.NotNil(t, err)
 	// Pack、NewRequest、Do、ReadAll成功，但Unpack失败
-	resp, err := caller.Call(req)
+	resp, err := caller.Call(context.Background(), req)
 	assert.NotNil(t, err)
 	assert.Nil(t, resp)
 	// Pack、NewRequest、Do、ReadAll、Unpack成功
-	//resp, err = caller.Call(req)
+	//resp, err = caller.Call(context.Background(), req)
 	//assert.Nil(t, err)
 	//assert.NotNil(t, resp)
 
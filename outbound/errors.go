@@ -0,0 +1,41 @@
+package outbound
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrQTypeDisabled 请求类型被分组屏蔽
+var ErrQTypeDisabled = errors.New("query type disabled")
+
+// UpstreamError 分组内所有上游均请求失败
+type UpstreamError struct {
+	Group string
+	Errs  []error // 各上游的错误，分组未配置上游时为空
+}
+
+func (e *UpstreamError) Error() string {
+	if len(e.Errs) == 0 {
+		return "no upstream for group " + e.Group
+	}
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "all upstreams of group " + e.Group + " failed: " + strings.Join(msgs, "; ")
+}
+
+// IsNetwork 是否所有上游均因网络错误（超时、连接失败等）而失败
+func (e *UpstreamError) IsNetwork() bool {
+	if len(e.Errs) == 0 {
+		return false
+	}
+	for _, err := range e.Errs {
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			return false
+		}
+	}
+	return true
+}
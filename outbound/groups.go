@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -23,9 +24,11 @@ import (
 )
 
 type IGroup interface {
-	Match(req *dns.Msg) bool
+	MatchRules(req *dns.Msg) bool
+	MatchGFWList(req *dns.Msg) bool
 	IsFallback() bool
-	Handle(req *dns.Msg) *dns.Msg
+	// Handle 将请求转发至上游，ctx结束时取消未完成的上游请求。失败时返回ErrQTypeDisabled或*UpstreamError
+	Handle(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	PostProcess(req *dns.Msg, resp *dns.Msg)
 	Start(resolver dns.Handler)
 	Stop()
@@ -33,8 +36,142 @@ type IGroup interface {
 	String() string
 }
 
-func BuildGroups(globalConf config.Conf) (map[string]IGroup, error) {
+// GroupInfo 分组的配置及运行状态
+type GroupInfo struct {
+	Name       string   `json:"name"`
+	Fallback   bool     `json:"fallback"`
+	Upstreams  []string `json:"upstreams"`
+	Concurrent bool     `json:"concurrent"`
+	FastestIP  bool     `json:"fastest_ip"`
+	// GFWListUpdated gfwlist最后一次从gfwlist_url更新成功的时间，未更新时为nil
+	GFWListUpdated *time.Time `json:"gfwlist_updated,omitempty"`
+	Requests       uint64     `json:"requests"` // 处理的请求数
+	Failures       uint64     `json:"failures"` // 所有上游均失败的请求数
+}
+
+// Groups BuildGroups的构建结果，包含所有分组及按优先级排列的匹配流水线
+type Groups struct {
+	groups   map[string]IGroup
+	pipeline []matchStage
+	fallback IGroup
+}
+
+// matchStage 匹配流水线中的一个环节：使用指定分组的rules或gfwlist进行匹配
+type matchStage struct {
+	group    IGroup
+	priority int
+	gfwList  bool
+}
+
+func (s matchStage) match(req *dns.Msg) bool {
+	if s.gfwList {
+		return s.group.MatchGFWList(req)
+	}
+	return s.group.MatchRules(req)
+}
+
+// Priority 分组的匹配优先级，值越大越优先
+type Priority struct {
+	Rules   int
+	GFWList int
+}
+
+// NewGroups 根据分组构建匹配流水线。优先级高的环节先匹配，同优先级时rules先于gfwlist，再按组名排序
+func NewGroups(groups map[string]IGroup, priorities map[string]Priority) *Groups {
+	gs := &Groups{groups: groups, pipeline: make([]matchStage, 0, len(groups)*2)}
+	for name, group := range groups {
+		if group.IsFallback() {
+			gs.fallback = group
+		}
+		p := priorities[name]
+		gs.pipeline = append(gs.pipeline,
+			matchStage{group: group, priority: p.Rules, gfwList: false},
+			matchStage{group: group, priority: p.GFWList, gfwList: true},
+		)
+	}
+	sort.Slice(gs.pipeline, func(i, j int) bool {
+		a, b := gs.pipeline[i], gs.pipeline[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.gfwList != b.gfwList {
+			return !a.gfwList
+		}
+		return a.group.Name() < b.group.Name()
+	})
+	return gs
+}
+
+// Match 按流水线顺序匹配请求，返回第一个匹配的分组，均未匹配时返回nil
+func (gs *Groups) Match(req *dns.Msg) IGroup {
+	for _, stage := range gs.pipeline {
+		if stage.match(req) {
+			return stage.group
+		}
+	}
+	return nil
+}
+
+// Subset 使用names中的分组构建新的匹配流水线，靠前的分组优先匹配，names为空时沿用原流水线；
+// fallback不为空时使用该分组作为兜底分组
+func (gs *Groups) Subset(names []string, fallback string) (*Groups, error) {
+	sub := &Groups{groups: map[string]IGroup{}, fallback: gs.fallback}
+	if fallback != "" {
+		if sub.fallback = gs.groups[fallback]; sub.fallback == nil {
+			return nil, fmt.Errorf("fallback group %q not exists", fallback)
+		}
+	}
+	if len(names) == 0 {
+		for name, group := range gs.groups {
+			sub.groups[name] = group
+		}
+		sub.pipeline = gs.pipeline
+	} else {
+		for _, name := range names {
+			if _, exists := gs.groups[name]; !exists {
+				return nil, fmt.Errorf("group %q not exists", name)
+			}
+			if _, exists := sub.groups[name]; exists {
+				return nil, fmt.Errorf("duplicate group %q", name)
+			}
+			sub.groups[name] = gs.groups[name]
+			for _, stage := range gs.pipeline {
+				if stage.group.Name() == name {
+					sub.pipeline = append(sub.pipeline, stage)
+				}
+			}
+		}
+	}
+	if sub.fallback != nil {
+		sub.groups[sub.fallback.Name()] = sub.fallback
+	}
+	return sub, nil
+}
+
+// Get 根据组名获取分组，不存在时返回nil
+func (gs *Groups) Get(name string) IGroup { return gs.groups[name] }
+
+// All 返回组名到分组的映射
+func (gs *Groups) All() map[string]IGroup { return gs.groups }
+
+// Fallback 返回兜底分组，未设置时返回nil
+func (gs *Groups) Fallback() IGroup { return gs.fallback }
+
+// CallHook 每次请求上游完成后的回调，begin为发起请求的时间。用于dnstap、监控指标等
+type CallHook func(ctx context.Context, group string, caller Caller, req, resp *dns.Msg, begin time.Time, err error)
+
+// OnCall 为所有分组注册上游请求的回调，需在分组处理请求前调用
+func (gs *Groups) OnCall(hook CallHook) {
+	for _, group := range gs.groups {
+		if g, ok := group.(*groupImpl); ok {
+			g.callHooks = append(g.callHooks, hook)
+		}
+	}
+}
+
+func BuildGroups(globalConf config.Conf) (*Groups, error) {
 	groups := make(map[string]IGroup, len(globalConf.Groups))
+	priorities := make(map[string]Priority, len(globalConf.Groups))
 	// check non-repeatable flag
 	seenGFWList, seenFallback := false, false
 	// build groups
@@ -173,9 +310,10 @@ func BuildGroups(globalConf config.Conf) (map[string]IGroup, error) {
 			g.ipSet6 = ipSetWrapper{is}
 		}
 		groups[name] = g
+		priorities[name] = Priority{Rules: conf.Priority, GFWList: conf.GFWListPriority}
 	}
 
-	return groups, nil
+	return NewGroups(groups, priorities), nil
 }
 
 var (
@@ -206,36 +344,83 @@ type groupImpl struct {
 
 	stopCh  chan struct{}
 	stopped chan struct{}
+
+	callHooks []CallHook
+
+	requestCnt     uint64
+	failedCnt      uint64
+	gfwListUpdated int64 // unix时间戳，原子操作
 }
 
 func (g *groupImpl) Name() string     { return g.name }
 func (g *groupImpl) String() string   { return "group_" + g.Name() }
 func (g *groupImpl) IsFallback() bool { return g.fallback }
 
-func (g *groupImpl) Match(req *dns.Msg) bool {
-	domain := ""
+func questionName(req *dns.Msg) string {
 	if len(req.Question) > 0 {
-		domain = req.Question[0].Name
+		return req.Question[0].Name
 	}
-	if domain == "" {
+	return ""
+}
+
+func (g *groupImpl) MatchRules(req *dns.Msg) bool {
+	domain := questionName(req)
+	if domain == "" || g.matcher == nil {
 		return false
 	}
+	match, _ := g.matcher.Match(domain)
+	return match
+}
 
-	if match, _ := g.matcher.Match(domain); match {
-		return true
+func (g *groupImpl) MatchGFWList(req *dns.Msg) bool {
+	domain := questionName(req)
+	if domain == "" {
+		return false
 	}
 	if ptr := atomic.LoadPointer(&g.gfwList); ptr != nil {
-		if match, _ := (*matcher.ABPlus)(ptr).Match(domain); match {
-			return true
-		}
+		match, _ := (*matcher.ABPlus)(ptr).Match(domain)
+		return match
 	}
 	return false
 }
 
-func (g *groupImpl) Handle(req *dns.Msg) *dns.Msg {
+// Inspect 返回分组的配置及运行状态，分组未实现Info方法时仅包含分组名
+func Inspect(group IGroup) GroupInfo {
+	if g, ok := group.(interface{ Info() GroupInfo }); ok {
+		return g.Info()
+	}
+	return GroupInfo{Name: group.Name(), Upstreams: []string{}}
+}
+
+func (g *groupImpl) Info() GroupInfo {
+	info := GroupInfo{
+		Name: g.name, Fallback: g.fallback, Upstreams: make([]string, 0, len(g.callers)),
+		Concurrent: g.concurrent, FastestIP: g.fastestIP,
+		Requests: atomic.LoadUint64(&g.requestCnt), Failures: atomic.LoadUint64(&g.failedCnt),
+	}
+	for _, caller := range g.callers {
+		info.Upstreams = append(info.Upstreams, caller.String())
+	}
+	if ts := atomic.LoadInt64(&g.gfwListUpdated); ts > 0 {
+		updated := time.Unix(ts, 0)
+		info.GFWListUpdated = &updated
+	}
+	return info
+}
+
+func (g *groupImpl) Handle(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint64(&g.requestCnt, 1)
+	resp, err := g.handle(ctx, req)
+	if err != nil && !errors.Is(err, ErrQTypeDisabled) {
+		atomic.AddUint64(&g.failedCnt, 1)
+	}
+	return resp, err
+}
+
+func (g *groupImpl) handle(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	for _, question := range req.Question {
 		if g.disableQTypes[question.Qtype] {
-			return nil // disabled
+			return nil, ErrQTypeDisabled
 		}
 	}
 	// 预处理请求
@@ -249,31 +434,33 @@ func (g *groupImpl) Handle(req *dns.Msg) *dns.Msg {
 		}
 	}
 
+	upstreamErr := &UpstreamError{Group: g.name}
 	if !g.concurrent && !g.fastestIP {
 		// 依次请求上游DNS
 		for _, caller := range g.callers {
-			resp, err := caller.Call(req)
+			if err := ctx.Err(); err != nil {
+				upstreamErr.Errs = append(upstreamErr.Errs, err)
+				break
+			}
+			resp, err := g.call(ctx, caller, req)
 			if err != nil {
-				logrus.Warnf("group %s call %s failed: %+v", g.name, caller, err)
+				upstreamErr.Errs = append(upstreamErr.Errs, err)
 				continue
 			}
-			return resp
+			return resp, nil
 		}
-		return nil
+		return nil, upstreamErr
 	}
 
-	// 并发请求上游DNS
+	// 并发请求上游DNS，返回后取消仍未完成的请求
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	chLen := len(g.callers)
-	respCh := make(chan *dns.Msg, chLen)
+	respCh := make(chan callResult, chLen)
 	for _, caller := range g.callers {
 		go func(caller Caller) {
-			resp, err := caller.Call(req)
-			if err == nil {
-				respCh <- resp
-			} else {
-				logrus.Warnf("group %s call %s failed: %+v", g.name, caller, err)
-				respCh <- nil
-			}
+			resp, err := g.call(ctx, caller, req)
+			respCh <- callResult{caller: caller, resp: resp, err: err}
 		}(caller)
 	}
 	// 处理响应
@@ -283,18 +470,63 @@ func (g *groupImpl) Handle(req *dns.Msg) *dns.Msg {
 	}
 	if (qType == dns.TypeA || qType == dns.TypeAAAA) && g.fastestIP {
 		// 测速并返回最快ip
-		return g.fastestResp(qType, respCh, chLen)
+		if resp := g.fastestResp(ctx, qType, respCh, chLen, upstreamErr); resp != nil {
+			return resp, nil
+		}
+		return nil, upstreamErr
 	}
-	// 无需测速，只需返回第一个不为nil的DNS响应
+	// 无需测速，只需返回第一个成功的DNS响应
 	for i := 0; i < chLen; i++ {
-		if resp := <-respCh; resp != nil {
-			return resp
-		}
+		var res callResult
+		select {
+		case res = <-respCh:
+		case <-ctx.Done():
+			upstreamErr.Errs = append(upstreamErr.Errs, ctx.Err())
+			return nil, upstreamErr
+		}
+		if res.err == nil {
+			utils.CtxDebug(ctx, "group %s use response of %s", g.name, res.caller)
+			return res.resp, nil
+		}
+		upstreamErr.Errs = append(upstreamErr.Errs, res.err)
 	}
-	return nil
+	return nil, upstreamErr
 }
 
-func (g *groupImpl) fastestResp(qType uint16, respCh chan *dns.Msg, chLen int) *dns.Msg {
+// call 请求单个上游并记录结果
+func (g *groupImpl) call(ctx context.Context, caller Caller, req *dns.Msg) (*dns.Msg, error) {
+	begin := time.Now()
+	resp, err := caller.Call(ctx, req)
+	elapsed := time.Since(begin)
+	cost := elapsed.Milliseconds()
+	upstream := caller.String()
+	upstreamRequests.Inc(g.name, upstream)
+	switch {
+	case err == nil:
+		upstreamDuration.Observe(elapsed.Seconds(), g.name, upstream)
+		utils.CtxDebug(ctx, "group %s call %s success, cost %dms", g.name, caller, cost)
+	case errors.Is(err, context.Canceled):
+		utils.CtxDebug(ctx, "group %s call %s cancelled, cost %dms", g.name, caller, cost)
+	default:
+		upstreamErrors.Inc(g.name, upstream)
+		utils.CtxWarn(ctx, "group %s call %s failed, cost %dms: %+v", g.name, caller, cost, err)
+	}
+	for _, hook := range g.callHooks {
+		hook(ctx, g.name, caller, req, resp, begin, err)
+	}
+	return resp, err
+}
+
+// callResult 一次上游请求的结果
+type callResult struct {
+	caller Caller
+	resp   *dns.Msg
+	err    error
+}
+
+// fastestResp 从respCh中选出ping值最低的响应，全部失败时返回nil并将错误记录到upstreamErr
+func (g *groupImpl) fastestResp(ctx context.Context, qType uint16, respCh chan callResult, chLen int,
+	upstreamErr *UpstreamError) *dns.Msg {
 	const (
 		maxGoNum    = 15 // 最大并发量
 		pingTimeout = 500 * time.Millisecond
@@ -304,10 +536,21 @@ func (g *groupImpl) fastestResp(qType uint16, respCh chan *dns.Msg, chLen int) *
 	respMap := make(map[string]*dns.Msg, maxGoNum)
 	var firstResp *dns.Msg // 最早抵达的msg，当测速失败时返回该响应
 	for i := 0; i < chLen; i++ {
-		resp := <-respCh
-		if resp == nil {
+		var res callResult
+		select {
+		case res = <-respCh:
+		case <-ctx.Done():
+			// 已有响应时直接测速，否则返回nil
+			if firstResp == nil {
+				upstreamErr.Errs = append(upstreamErr.Errs, ctx.Err())
+			}
+			goto doPing
+		}
+		if res.err != nil {
+			upstreamErr.Errs = append(upstreamErr.Errs, res.err)
 			continue
 		}
+		resp := res.resp
 		if firstResp == nil {
 			firstResp = resp
 		}
@@ -343,11 +586,12 @@ doPing:
 			return resp
 		}
 	}
-	fastestIP, cost, err := utils.FastestPingIP(allIP, g.tcpPingPort, pingTimeout)
+	fastestIP, cost, err := utils.FastestPingIP(ctx, allIP, g.tcpPingPort, pingTimeout)
 	if err != nil {
+		utils.CtxDebug(ctx, "group %s ping %s failed, use first response: %+v", g.name, allIP, err)
 		return firstResp
 	}
-	logrus.Debugf("fastest ip of %s: %s(%dms)", allIP, fastestIP, cost)
+	utils.CtxDebug(ctx, "group %s fastest ip of %s: %s(%dms)", g.name, allIP, fastestIP, cost)
 	msg := respMap[fastestIP]
 	// 删除msg内除fastestIP之外的其它IP记录
 	for i := 0; i < len(msg.Answer); i++ {
@@ -386,6 +630,7 @@ func (g *groupImpl) PostProcess(_ *dns.Msg, resp *dns.Msg) {
 			continue
 		}
 		if err := target.Add(val, target.GetTimeout()); err != nil {
+			ipSetAddFailures.Inc(g.name, target.GetName())
 			logrus.Warnf("add %s to ipset<%s> failed: %+v", val, target.GetName(), err)
 		}
 	}
@@ -421,11 +666,12 @@ func (g *groupImpl) grabGFWList() *matcher.ABPlus {
 		return nil
 	}
 	dst := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
-	if _, err = base64.StdEncoding.Decode(data, dst); err != nil {
+	n, err := base64.StdEncoding.Decode(dst, data)
+	if err != nil {
 		logrus.Warnf("decode gfw list %q failed, error: %+v", g.gfwListURL, err)
 		return nil
 	}
-	return matcher.NewABPByText(string(dst))
+	return matcher.NewABPByText(string(dst[:n]))
 }
 
 func (g *groupImpl) Start(resolver dns.Handler) {
@@ -445,6 +691,11 @@ func (g *groupImpl) Start(resolver dns.Handler) {
 				if m := g.grabGFWList(); m != nil {
 					atomic.StorePointer(&g.gfwList, unsafe.Pointer(m))
 					lastSuccess = time.Now()
+					atomic.StoreInt64(&g.gfwListUpdated, lastSuccess.Unix())
+					gfwListRefreshes.Inc(g.name, "success")
+					gfwListUpdated.Set(float64(lastSuccess.Unix()), g.name)
+				} else if g.gfwListURL != "" {
+					gfwListRefreshes.Inc(g.name, "failure")
 				}
 			case <-g.stopCh:
 				close(g.stopped)
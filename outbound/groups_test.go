@@ -1,11 +1,19 @@
 package outbound
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/metrics"
 )
 
 func TestBuildGroups(t *testing.T) {
@@ -54,9 +62,9 @@ func TestDisableIPv6(t *testing.T) {
 		"g1": {DisableIPv6: true, DisableQTypes: []string{"AAAA"}},
 	}})
 	assert.Nil(t, err)
-	g := groups["g1"]
+	g := groups.Get("g1")
 	assert.NotNil(t, g)
-	resp := g.Handle(&dns.Msg{
+	resp, err := g.Handle(context.Background(), &dns.Msg{
 		Question: []dns.Question{{
 			Name:   "z.cn.",
 			Qtype:  dns.TypeAAAA,
@@ -64,6 +72,48 @@ func TestDisableIPv6(t *testing.T) {
 		}},
 	})
 	assert.Nil(t, resp)
+	assert.Equal(t, ErrQTypeDisabled, err)
+}
+
+func TestGroupsMatch(t *testing.T) {
+	gfwListFile := "../matcher/testdata/gfwlist.txt"
+	req := &dns.Msg{Question: []dns.Question{{Name: "www.google.com.", Qtype: dns.TypeA}}}
+	t.Run("rules_before_gfwlist", func(t *testing.T) {
+		groups, err := BuildGroups(config.Conf{Groups: map[string]config.Group{
+			"clean": {Fallback: true},
+			"dirty": {GFWListFile: gfwListFile},
+			"work":  {Rules: []string{"google.com"}},
+		}})
+		assert.Nil(t, err)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "work", groups.Match(req).Name())
+		}
+		assert.Equal(t, "clean", groups.Fallback().Name())
+		assert.Nil(t, groups.Match(&dns.Msg{}))
+	})
+	t.Run("priority", func(t *testing.T) {
+		groups, err := BuildGroups(config.Conf{Groups: map[string]config.Group{
+			"dirty": {GFWListFile: gfwListFile, GFWListPriority: 1},
+			"work":  {Rules: []string{"google.com"}},
+		}})
+		assert.Nil(t, err)
+		assert.Equal(t, "dirty", groups.Match(req).Name())
+
+		groups, err = BuildGroups(config.Conf{Groups: map[string]config.Group{
+			"a": {Rules: []string{"google.com"}},
+			"b": {Rules: []string{"google.com"}},
+			"c": {Rules: []string{"google.com"}, Priority: -1},
+		}})
+		assert.Nil(t, err)
+		assert.Equal(t, "a", groups.Match(req).Name())
+
+		groups, err = BuildGroups(config.Conf{Groups: map[string]config.Group{
+			"a": {Rules: []string{"google.com"}},
+			"b": {Rules: []string{"google.com"}, Priority: 10},
+		}})
+		assert.Nil(t, err)
+		assert.Equal(t, "b", groups.Match(req).Name())
+	})
 }
 
 func TestPostProcess(t *testing.T) {
@@ -90,3 +140,148 @@ func TestPostProcess(t *testing.T) {
 	group.PostProcess(nil, &dns.Msg{Answer: []dns.RR{rr}})
 	assert.Equal(t, "ff80::1", v6val)
 }
+
+func TestGroupsSubset(t *testing.T) {
+	req := &dns.Msg{Question: []dns.Question{{Name: "company.com.", Qtype: dns.TypeA}}}
+	groups, err := BuildGroups(config.Conf{Groups: map[string]config.Group{
+		"clean":  {Fallback: true},
+		"filter": {Rules: []string{"company.com"}},
+		"work":   {Rules: []string{"company.com"}},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "filter", groups.Match(req).Name())
+
+	sub, err := groups.Subset([]string{"work", "filter"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "work", sub.Match(req).Name())
+	assert.Equal(t, "clean", sub.Fallback().Name())
+	assert.Equal(t, 3, len(sub.All()))
+
+	sub, err = groups.Subset(nil, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, "filter", sub.Match(req).Name())
+	assert.Equal(t, "work", sub.Fallback().Name())
+
+	_, err = groups.Subset([]string{"dirty"}, "")
+	assert.NotNil(t, err)
+	_, err = groups.Subset([]string{"work", "work"}, "")
+	assert.NotNil(t, err)
+	_, err = groups.Subset(nil, "dirty")
+	assert.NotNil(t, err)
+}
+
+func TestGroupInfo(t *testing.T) {
+	groups, err := BuildGroups(config.Conf{Groups: map[string]config.Group{
+		"g1": {DNS: []string{"1.1.1.1"}, Concurrent: true, DisableQTypes: []string{"AAAA"}},
+	}})
+	assert.Nil(t, err)
+	g := groups.Get("g1")
+	_, err = g.Handle(context.Background(), &dns.Msg{Question: []dns.Question{{Name: "z.cn.", Qtype: dns.TypeAAAA}}})
+	assert.Equal(t, ErrQTypeDisabled, err)
+
+	info := Inspect(g)
+	assert.Equal(t, "g1", info.Name)
+	assert.True(t, info.Fallback)
+	assert.True(t, info.Concurrent)
+	assert.Equal(t, []string{"DNSCaller<1.1.1.1:53/udp>"}, info.Upstreams)
+	assert.Nil(t, info.GFWListUpdated)
+	assert.Equal(t, uint64(1), info.Requests)
+	assert.Equal(t, uint64(0), info.Failures)
+}
+
+// fakeCaller 延迟delay后返回响应，ctx结束时提前返回并记录
+type fakeCaller struct {
+	delay     time.Duration
+	cancelled chan struct{}
+}
+
+func (c *fakeCaller) Call(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	select {
+	case <-time.After(c.delay):
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		return resp, nil
+	case <-ctx.Done():
+		close(c.cancelled)
+		return nil, ctx.Err()
+	}
+}
+func (c *fakeCaller) Start(dns.Handler) {}
+func (c *fakeCaller) Exit()             {}
+func (c *fakeCaller) String() string    { return "fakeCaller" }
+func (c *fakeCaller) Protocol() string  { return "udp" }
+func (c *fakeCaller) Address() string   { return "127.0.0.1:53" }
+
+func TestGroupCancel(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	fast := &fakeCaller{delay: 0, cancelled: make(chan struct{})}
+	slow := &fakeCaller{delay: time.Minute, cancelled: make(chan struct{})}
+
+	// concurrent: the losing call is cancelled after the first answer
+	g := &groupImpl{name: "g1", concurrent: true, callers: []Caller{fast, slow}}
+	resp, err := g.Handle(context.Background(), req)
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	select {
+	case <-slow.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow caller not cancelled")
+	}
+
+	// serial: deadline exceeded
+	slow = &fakeCaller{delay: time.Minute, cancelled: make(chan struct{})}
+	g = &groupImpl{name: "g1", callers: []Caller{slow, fast}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = g.Handle(ctx, req)
+	var upstreamErr *UpstreamError
+	assert.True(t, errors.As(err, &upstreamErr))
+	assert.True(t, upstreamErr.IsNetwork())
+	assert.Equal(t, 2, len(upstreamErr.Errs)) // slow failed, fast skipped
+}
+
+func TestGrabGFWList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gfwlist.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("[AutoProxy]\n||google.com\n"))))
+	}))
+	defer srv.Close()
+	g := &groupImpl{gfwListURL: srv.URL + "/gfwlist.txt"}
+	m := g.grabGFWList()
+	assert.NotNil(t, m)
+	match, _ := m.Match("www.google.com.")
+	assert.True(t, match)
+
+	g.gfwListURL = srv.URL + "/not_exists.txt"
+	assert.Nil(t, g.grabGFWList())
+}
+
+func TestGroupMetrics(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	g := &groupImpl{
+		name:    "metrics_test",
+		callers: []Caller{&fakeCaller{cancelled: make(chan struct{})}},
+		ipSet: MockIPSet{
+			Name:    "v4",
+			MockAdd: func(string, int) error { return errors.New("permission denied") },
+		},
+	}
+	resp, err := g.Handle(context.Background(), req)
+	assert.Nil(t, err)
+	rr, _ := dns.NewRR("z.cn 0 IN A 1.1.1.1")
+	resp.Answer = []dns.RR{rr}
+	g.PostProcess(req, resp)
+
+	buf := new(bytes.Buffer)
+	_, err = metrics.Default.WriteTo(buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `tsdns_upstream_requests_total{group="metrics_test",upstream="fakeCaller"} 1`)
+	assert.Contains(t, buf.String(), `tsdns_upstream_request_duration_seconds_count{group="metrics_test",upstream="fakeCaller"} 1`)
+	assert.NotContains(t, buf.String(), `tsdns_upstream_errors_total{group="metrics_test"`)
+	assert.Contains(t, buf.String(), `tsdns_ipset_add_failures_total{group="metrics_test",ipset="v4"} 1`)
+}
@@ -0,0 +1,27 @@
+package outbound
+
+import (
+	"github.com/wolf-joe/ts-dns/metrics"
+)
+
+// 上游、ipset及gfwlist相关的监控指标，upstream标签与GroupInfo.Upstreams一致
+var (
+	upstreamRequests = metrics.NewCounterVec("tsdns_upstream_requests_total",
+		"Requests sent to upstream servers.", "group", "upstream")
+	upstreamErrors = metrics.NewCounterVec("tsdns_upstream_errors_total",
+		"Failed requests to upstream servers, requests cancelled by a faster upstream are not included.",
+		"group", "upstream")
+	upstreamDuration = metrics.NewHistogramVec("tsdns_upstream_request_duration_seconds",
+		"Latency of successful requests to upstream servers.", nil, "group", "upstream")
+	ipSetAddFailures = metrics.NewCounterVec("tsdns_ipset_add_failures_total",
+		"Failures of adding resolved addresses to ipset.", "group", "ipset")
+	gfwListRefreshes = metrics.NewCounterVec("tsdns_gfwlist_refresh_total",
+		"GFWList refresh attempts from gfwlist_url.", "group", "result")
+	gfwListUpdated = metrics.NewGaugeVec("tsdns_gfwlist_last_update_timestamp_seconds",
+		"Unix time of the last successful GFWList refresh.", "group")
+)
+
+func init() {
+	metrics.Default.MustRegister(upstreamRequests, upstreamErrors, upstreamDuration,
+		ipSetAddFailures, gfwListRefreshes, gfwListUpdated)
+}
@@ -0,0 +1,165 @@
+package querylog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fastrand"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+const (
+	queueSize     = 4096 // 待写入日志的队列长度，队列满时丢弃日志
+	flushInterval = time.Second
+)
+
+// Entry 一条查询日志
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Trace     string    `json:"trace,omitempty"`
+	Client    string    `json:"client"`
+	View      string    `json:"view,omitempty"`
+	Question  string    `json:"question"`
+	QType     string    `json:"qtype"`
+	Group     string    `json:"group,omitempty"` // 匹配的分组
+	Fallback  bool      `json:"fallback,omitempty"`
+	Redirect  string    `json:"redirect,omitempty"` // 重定向的目标分组
+	Hosts     bool      `json:"hosts,omitempty"`
+	Cache     bool      `json:"cache,omitempty"`
+	Stale     bool      `json:"stale,omitempty"`
+	Coalesced bool      `json:"coalesced,omitempty"` // 复用了相同的进行中请求的结果
+	Blocked   bool      `json:"blocked,omitempty"`   // 被拒绝、限速或屏蔽
+	Rcode     string    `json:"rcode"`               // 未响应时为空
+	Answers   []string  `json:"answers,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Latency   float64   `json:"latency_ms"`
+}
+
+// Failed 是否为被拦截或失败（未响应或rcode不为NOERROR/NXDOMAIN）的查询
+func (e *Entry) Failed() bool {
+	return e.Blocked || e.Error != "" || (e.Rcode != "NOERROR" && e.Rcode != "NXDOMAIN")
+}
+
+// Logger 查询日志，在后台以JSON lines格式写入日志文件
+type Logger struct {
+	sampleRate float64
+	onlyFailed bool
+	file       *rotateFile
+	entries    chan *Entry
+	dropped    uint64
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+	stopped   chan struct{}
+}
+
+// NewLogger 校验配置并确认日志文件可写，未配置日志文件时返回nil
+func NewLogger(conf config.QueryLogConf) (*Logger, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+	if conf.MaxSize < 0 || conf.RotateInterval < 0 || conf.MaxBackups < 0 {
+		return nil, errors.New("max_size/rotate_interval/max_backups should not be negative")
+	}
+	if conf.SampleRate < 0 || conf.SampleRate > 1 {
+		return nil, errors.New("sample_rate should be in range [0, 1]")
+	}
+	file, err := os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_ = file.Close()
+	return &Logger{
+		sampleRate: conf.SampleRate,
+		onlyFailed: conf.OnlyFailed,
+		file: &rotateFile{
+			path:       conf.File,
+			maxSize:    int64(conf.MaxSize) << 20,
+			interval:   time.Duration(conf.RotateInterval) * time.Second,
+			maxBackups: conf.MaxBackups,
+			compress:   conf.Compress,
+		},
+		entries: make(chan *Entry, queueSize),
+		stopCh:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// Log 按only_failed及sample_rate过滤后将日志放入写入队列，不会阻塞
+func (l *Logger) Log(entry *Entry) {
+	if l.onlyFailed && !entry.Failed() {
+		return
+	}
+	if l.sampleRate > 0 && l.sampleRate < 1 && float64(fastrand.Uint32n(1<<20)) >= l.sampleRate*(1<<20) {
+		return
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Dropped 返回因队列已满而丢弃的日志数
+func (l *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Start 启动后台写入，重复调用无效
+func (l *Logger) Start() {
+	l.startOnce.Do(func() { go l.run() })
+}
+
+// Stop 写入队列中剩余的日志并关闭文件，重复调用无效
+func (l *Logger) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopCh)
+		l.Start() // 未启动时也需关闭stopped
+		<-l.stopped
+	})
+}
+
+func (l *Logger) run() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-l.entries:
+			l.write(entry)
+		case <-ticker.C:
+			if err := l.file.Flush(); err != nil {
+				logrus.Warnf("flush query log failed: %+v", err)
+			}
+		case <-l.stopCh:
+			for {
+				select {
+				case entry := <-l.entries:
+					l.write(entry)
+				default:
+					if err := l.file.Close(); err != nil {
+						logrus.Warnf("close query log failed: %+v", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Logger) write(entry *Entry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Warnf("marshal query log failed: %+v", err)
+		return
+	}
+	if err = l.file.WriteLine(append(line, '\n')); err != nil {
+		logrus.Warnf("write query log failed: %+v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer func() { _ = file.Close() }()
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := Entry{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestNewLogger(t *testing.T) {
+	l, err := NewLogger(config.QueryLogConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	path := filepath.Join(t.TempDir(), "query.log")
+	_, err = NewLogger(config.QueryLogConf{File: path, MaxSize: -1})
+	assert.NotNil(t, err)
+	_, err = NewLogger(config.QueryLogConf{File: path, SampleRate: 2})
+	assert.NotNil(t, err)
+	_, err = NewLogger(config.QueryLogConf{File: filepath.Join(path, "not_exists", "query.log")})
+	assert.NotNil(t, err)
+
+	// stop without start
+	l, err = NewLogger(config.QueryLogConf{File: path})
+	assert.Nil(t, err)
+	l.Stop()
+	l.Stop()
+}
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	l, err := NewLogger(config.QueryLogConf{File: path})
+	assert.Nil(t, err)
+	l.Start()
+	l.Log(&Entry{Client: "127.0.0.1", Question: "z.cn.", QType: "A", Rcode: "NOERROR", Answers: []string{"z.cn.\t60\tIN\tA\t1.1.1.1"}})
+	l.Log(&Entry{Client: "127.0.0.1", Question: "z.cn.", QType: "AAAA", Rcode: "NOERROR", Blocked: true})
+	l.Stop()
+	l.Log(&Entry{}) // ignored after stop
+
+	entries := readEntries(t, path)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "A", entries[0].QType)
+	assert.Equal(t, 1, len(entries[0].Answers))
+	assert.True(t, entries[1].Blocked)
+	assert.Equal(t, uint64(0), l.Dropped())
+}
+
+func TestLoggerFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	l, err := NewLogger(config.QueryLogConf{File: path, OnlyFailed: true})
+	assert.Nil(t, err)
+	l.Start()
+	l.Log(&Entry{Question: "a.cn.", Rcode: "NOERROR"})
+	l.Log(&Entry{Question: "b.cn.", Rcode: "NXDOMAIN"})
+	l.Log(&Entry{Question: "c.cn.", Rcode: "SERVFAIL"})
+	l.Log(&Entry{Question: "d.cn.", Rcode: "NOERROR", Blocked: true})
+	l.Log(&Entry{Question: "e.cn."}) // dropped without response
+	l.Stop()
+	var names []string
+	for _, entry := range readEntries(t, path) {
+		names = append(names, entry.Question)
+	}
+	assert.Equal(t, []string{"c.cn.", "d.cn.", "e.cn."}, names)
+
+	// sample about 10% of queries
+	path = filepath.Join(t.TempDir(), "query.log")
+	l, err = NewLogger(config.QueryLogConf{File: path, SampleRate: 0.1})
+	assert.Nil(t, err)
+	l.Start()
+	for i := 0; i < 1000; i++ {
+		l.Log(&Entry{Question: "a.cn.", Rcode: "NOERROR"})
+	}
+	l.Stop()
+	count := len(readEntries(t, path))
+	assert.Greater(t, count, 30)
+	assert.Less(t, count, 300)
+}
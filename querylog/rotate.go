@@ -0,0 +1,168 @@
+package querylog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat 轮转文件名中的时间格式，按字典序排序即为时间顺序
+const backupTimeFormat = "20060102-150405.000"
+
+// rotateFile 按大小及时间轮转的日志文件，每次写入一行，不会将一行拆分至两个文件。非并发安全
+type rotateFile struct {
+	path       string
+	maxSize    int64         // 为0时不按大小轮转
+	interval   time.Duration // 为0时不按时间轮转
+	maxBackups int           // 为0时保留所有轮转文件
+	compress   bool
+
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64 // 当前文件大小，含未刷新的内容
+	openedAt time.Time
+}
+
+func (f *rotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size, f.openedAt = file, stat.Size(), time.Now()
+	f.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// WriteLine 写入一行日志，写入前按需轮转
+func (f *rotateFile) WriteLine(line []byte) error {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return fmt.Errorf("open %q failed: %w", f.path, err)
+		}
+	}
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(line)) > f.maxSize) ||
+		(f.interval > 0 && time.Since(f.openedAt) >= f.interval)) {
+		if err := f.rotate(); err != nil {
+			return fmt.Errorf("rotate %q failed: %w", f.path, err)
+		}
+	}
+	n, err := f.writer.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// Flush 将缓冲区内的日志写入文件
+func (f *rotateFile) Flush() error {
+	if f.writer == nil {
+		return nil
+	}
+	return f.writer.Flush()
+}
+
+// Close 刷新缓冲区并关闭文件
+func (f *rotateFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.writer.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file, f.writer = nil, nil
+	return err
+}
+
+// rotate 将当前文件重命名为带时间后缀的轮转文件，按需压缩并删除多余的轮转文件，然后重新打开日志文件
+func (f *rotateFile) rotate() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if f.compress {
+		if err := gzipFile(backup); err != nil {
+			return fmt.Errorf("compress %q failed: %w", backup, err)
+		}
+	}
+	if err := f.prune(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// backups 按从旧到新的顺序返回所有轮转文件
+func (f *rotateFile) backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(f.path) + "."
+	var names []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) || entry.IsDir() {
+			continue
+		}
+		suffix := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), prefix), ".gz")
+		if _, err = time.Parse(backupTimeFormat, suffix); err == nil {
+			names = append(names, filepath.Join(filepath.Dir(f.path), entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// prune 删除超出max_backups的最旧的轮转文件
+func (f *rotateFile) prune() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	names, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for len(names) > f.maxBackups {
+		if err = os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// gzipFile 将文件压缩为同名的.gz文件并删除原文件
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
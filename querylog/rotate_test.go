@@ -0,0 +1,67 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "query.log")
+	f := &rotateFile{path: path, maxSize: 10, maxBackups: 2, compress: true}
+	line := []byte("123456\n")
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, f.WriteLine(line))
+		time.Sleep(2 * time.Millisecond) // avoid same backup name
+	}
+	assert.Nil(t, f.Close())
+
+	// each line is rotated to a new file, only 2 backups are kept
+	backups, err := f.backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(backups))
+	for _, name := range backups {
+		assert.True(t, strings.HasSuffix(name, ".gz"))
+		file, err := os.Open(name)
+		assert.Nil(t, err)
+		zr, err := gzip.NewReader(file)
+		assert.Nil(t, err)
+		content, _ := io.ReadAll(zr)
+		assert.Equal(t, line, content)
+		_ = file.Close()
+	}
+	content, _ := os.ReadFile(path)
+	assert.Equal(t, line, content)
+}
+
+func TestRotateFileInterval(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "query.log")
+	f := &rotateFile{path: path, interval: time.Hour}
+	assert.Nil(t, f.WriteLine([]byte("a\n")))
+	assert.Nil(t, f.WriteLine([]byte("b\n")))
+	f.openedAt = time.Now().Add(-time.Hour)
+	assert.Nil(t, f.WriteLine([]byte("c\n")))
+	assert.Nil(t, f.Close())
+
+	backups, err := f.backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(backups))
+	content, _ := os.ReadFile(backups[0])
+	assert.Equal(t, "a\nb\n", string(content))
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "c\n", string(content))
+
+	// reopen and append
+	assert.Nil(t, f.WriteLine([]byte("d\n")))
+	assert.Nil(t, f.Close())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "c\nd\n", string(content))
+}
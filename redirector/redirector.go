@@ -2,6 +2,7 @@ package redirector
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -10,7 +11,9 @@ import (
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/metrics"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/utils"
 	"github.com/yl2chen/cidranger"
 )
 
@@ -19,7 +22,15 @@ const (
 	TypeMisMatchCidr = "mismatch_cidr"
 )
 
-type Redirector func(src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup
+var redirectCnt = metrics.NewCounterVec("tsdns_redirects_total",
+	"Responses redirected to another group.", "redirector", "from", "to")
+
+func init() {
+	metrics.Default.MustRegister(redirectCnt)
+}
+
+// Redirector 根据src分组的响应判断是否需要重定向，返回重定向的目标分组。ctx已结束时不再重定向
+type Redirector func(ctx context.Context, src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup
 
 func NewRedirector(globalConf config.Conf, groups map[string]outbound.IGroup) (Redirector, error) {
 	// redirector name -> instance
@@ -48,16 +59,26 @@ func NewRedirector(globalConf config.Conf, groups map[string]outbound.IGroup) (R
 		}
 	}
 	// return runtime redirector
-	redirector := func(src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup {
+	redirector := func(ctx context.Context, src outbound.IGroup, req, resp *dns.Msg) outbound.IGroup {
 		instance, exists := group2redir[src.Name()]
 		if resp == nil || !exists {
 			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			utils.CtxDebug(ctx, "skip redirector %q: %+v", instance, err)
+			return nil
+		}
 		newGroup := instance.Redirect(req, resp)
-		if newGroup != nil && src.Name() == newGroup.Name() {
-			logrus.Warnf("redirector %q redirect to original group %q", instance, src)
+		if newGroup == nil {
+			utils.CtxDebug(ctx, "redirector %q keep group %q", instance, src)
+			return nil
+		}
+		if src.Name() == newGroup.Name() {
+			utils.CtxWarn(ctx, "redirector %q redirect to original group %q", instance, src)
 			return nil
 		}
+		utils.CtxDebug(ctx, "redirector %q redirect from group %q to %q", instance, src, newGroup)
+		redirectCnt.Inc(instance.Name(), src.Name(), newGroup.Name())
 		return newGroup
 	}
 	return redirector, nil
@@ -65,6 +86,7 @@ func NewRedirector(globalConf config.Conf, groups map[string]outbound.IGroup) (R
 
 type iRedirector interface {
 	Redirect(req, resp *dns.Msg) outbound.IGroup
+	Name() string
 	String() string
 }
 
@@ -106,6 +128,7 @@ func (r *cidrRedirector) Redirect(_, resp *dns.Msg) outbound.IGroup {
 	return nil
 }
 
+func (r *cidrRedirector) Name() string   { return r.name }
 func (r *cidrRedirector) String() string { return "cidr_redirector_" + r.name }
 
 func newCidrRedirector(name string, conf config.RedirectorConf, groups map[string]outbound.IGroup) (*cidrRedirector, error) {
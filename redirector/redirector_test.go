@@ -1,9 +1,12 @@
 package redirector
 
 import (
+	"bytes"
+	"context"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/metrics"
 	"github.com/wolf-joe/ts-dns/outbound"
 	"github.com/wolf-joe/ts-dns/utils/mock"
 	"testing"
@@ -124,7 +127,7 @@ func TestNewRedirector(t *testing.T) {
 		groups := map[string]outbound.IGroup{"g1": g1}
 		redir, err := NewRedirector(conf, groups)
 		assert.Nil(t, err)
-		newGroup := redir(g1, nil, newResp("1.1.1.1"))
+		newGroup := redir(context.Background(), g1, nil, newResp("1.1.1.1"))
 		assert.Nil(t, newGroup)
 	})
 	t.Run("redirect_success", func(t *testing.T) {
@@ -148,9 +151,16 @@ func TestNewRedirector(t *testing.T) {
 		redir, err := NewRedirector(conf, groups)
 		assert.Nil(t, err)
 		assert.NotNil(t, redir)
-		newGroup := redir(g1, nil, newResp("1.1.1.1"))
+		newGroup := redir(context.Background(), g1, nil, newResp("1.1.1.1"))
 		assert.NotNil(t, newGroup)
 		assert.Equal(t, "g2", newGroup.Name())
+		buf := new(bytes.Buffer)
+		_, _ = metrics.Default.WriteTo(buf)
+		assert.Contains(t, buf.String(), `tsdns_redirects_total{redirector="redir1",from="g1",to="g2"} 1`)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Nil(t, redir(ctx, g1, nil, newResp("1.1.1.1")))
 	})
 	t.Run("redirect_empty", func(t *testing.T) {
 		conf := config.Conf{
@@ -173,7 +183,7 @@ func TestNewRedirector(t *testing.T) {
 		redir, err := NewRedirector(conf, groups)
 		assert.Nil(t, err)
 		assert.NotNil(t, redir)
-		newGroup := redir(g1, nil, newResp("1.1.1.1"))
+		newGroup := redir(context.Background(), g1, nil, newResp("1.1.1.1"))
 		assert.Nil(t, newGroup)
 	})
 }
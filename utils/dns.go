@@ -122,3 +122,20 @@ func RemoveA(resp *dns.Msg) {
 		}
 	}
 }
+
+// SetEDE 当请求携带EDNS时，在响应中附加RFC 8914 Extended DNS Error
+func SetEDE(req, resp *dns.Msg, code uint16, text string) {
+	if req == nil || resp == nil {
+		return
+	}
+	reqOPT := req.IsEdns0()
+	if reqOPT == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOPT.UDPSize(), reqOPT.Do())
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
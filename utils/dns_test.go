@@ -96,3 +96,24 @@ func TestRemoveA(t *testing.T) {
 	RemoveA(resp)
 	assert.Equal(t, 1, len(resp.Answer))
 }
+
+func TestSetEDE(t *testing.T) {
+	SetEDE(nil, nil, dns.ExtendedErrorCodeBlocked, "")
+	req, resp := new(dns.Msg), new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	SetEDE(req, resp, dns.ExtendedErrorCodeBlocked, "blocked")
+	assert.Nil(t, resp.IsEdns0()) // 请求未携带EDNS
+
+	req.SetEdns0(1232, true)
+	SetEDE(req, resp, dns.ExtendedErrorCodeNetworkError, "network error")
+	SetEDE(req, resp, dns.ExtendedErrorCodeOther, "other")
+	opt := resp.IsEdns0()
+	assert.NotNil(t, opt)
+	assert.Equal(t, uint16(1232), opt.UDPSize())
+	assert.True(t, opt.Do())
+	assert.Equal(t, 2, len(opt.Option))
+	ede := opt.Option[0].(*dns.EDNS0_EDE)
+	assert.Equal(t, dns.ExtendedErrorCodeNetworkError, ede.InfoCode)
+	assert.Equal(t, "network error", ede.ExtraText)
+}
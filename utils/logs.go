@@ -16,6 +16,10 @@ func ctxLog(ctx context.Context, level logrus.Level, format string, args ...inte
 	} else {
 		logger = logrus.StandardLogger()
 	}
+	trace := CtxTrace(ctx) // 存在时间线时无论日志级别均需记录
+	if trace == nil && !logger.IsLevelEnabled(level) {
+		return
+	}
 	var logID uint16 // 从context内读取log id
 	if val, ok := ctx.Value(logIDKey).(uint16); ok {
 		logID = val
@@ -30,8 +34,11 @@ func ctxLog(ctx context.Context, level logrus.Level, format string, args ...inte
 	if _, file, line, ok := runtime.Caller(2); ok {
 		location = fmt.Sprintf("%s:%d", filepath.Base(file), line)
 	}
+	if trace != nil {
+		trace.add(level, location, fmt.Sprintf(format, args...))
+	}
 	// 统一输出格式
-	format = fmt.Sprintf("[0x%04x] [%s] %s", logID, location, format)
+	format = fmt.Sprintf("[%s] [%s] %s", FormatLogID(logID), location, format)
 	entry.Logf(level, format, args...)
 }
 
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"net"
 	"strconv"
@@ -9,8 +10,15 @@ import (
 	"github.com/sparrc/go-ping"
 )
 
-// PingIP 向指定ip地址发起icmp ping/tcp ping（如tcpPort大于0），返回值为nil代表ping成功
-func PingIP(ipAddr string, tcpPort int, timeout time.Duration) error {
+// PingIP 向指定ip地址发起icmp ping/tcp ping（如tcpPort大于0），返回值为nil代表ping成功。
+// 超时时间不超过ctx的deadline
+func PingIP(ctx context.Context, ipAddr string, tcpPort int, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
 	if tcpPort > 0 { // tcp ping
 		addr := ipAddr + ":" + strconv.Itoa(tcpPort)
 		conn, err := net.DialTimeout("tcp", addr, timeout)
@@ -34,22 +42,26 @@ func PingIP(ipAddr string, tcpPort int, timeout time.Duration) error {
 	return errors.New("package loss")
 }
 
-// FastestPingIP 向指定IP地址列表同时发起ping，返回ping值最低的IP地址和耗时
-func FastestPingIP(ipAddr []string, tcpPort int, timeout time.Duration,
+// FastestPingIP 向指定IP地址列表同时发起ping，返回ping值最低的IP地址和耗时。ctx结束时立即返回
+func FastestPingIP(ctx context.Context, ipAddr []string, tcpPort int, timeout time.Duration,
 ) (string, int64, error) {
 	pingDone := make(chan string, len(ipAddr))
 	begin := time.Now()
 	for _, ip := range ipAddr {
 		go func(addr string) {
-			if err := PingIP(addr, tcpPort, timeout); err == nil {
+			if err := PingIP(ctx, addr, tcpPort, timeout); err == nil {
 				pingDone <- addr
 			}
 		}(ip)
 	}
 	var fastestIP string // 第一个从chan返回的地址就是ping值最低的地址
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
 	case fastestIP = <-pingDone:
-	case <-time.After(timeout):
+	case <-timer.C:
+	case <-ctx.Done():
+		return "", 0, ctx.Err()
 	}
 	if fastestIP == "" {
 		return "", 0, errors.New("timeout")
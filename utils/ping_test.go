@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/wolf-joe/ts-dns/utils/mock"
@@ -16,23 +17,23 @@ import (
 
 func TestPingIP(t *testing.T) {
 	// icmp ping
-	assert.NotNil(t, PingIP("299.299.299.299", -1, time.Second))
+	assert.NotNil(t, PingIP(context.Background(), "299.299.299.299", -1, time.Second))
 	mocker := mock.Mocker{}
 	defer mocker.Reset()
 	mocker.MethodSeq(&ping.Pinger{}, "Statistics", []gomonkey.Params{
 		{&ping.Statistics{PacketsRecv: 1, AvgRtt: 100}},
 		{&ping.Statistics{PacketsRecv: 0, AvgRtt: 0}},
 	})
-	assert.Nil(t, PingIP("1.1.1.1", -1, time.Second))
-	assert.NotNil(t, PingIP("1.1.1.1", -1, time.Second))
+	assert.Nil(t, PingIP(context.Background(), "1.1.1.1", -1, time.Second))
+	assert.NotNil(t, PingIP(context.Background(), "1.1.1.1", -1, time.Second))
 
 	// tcp ping
 	mocker.FuncSeq(net.DialTimeout, []gomonkey.Params{
 		{nil, fmt.Errorf("err")}, {&net.TCPConn{}, nil},
 	})
 	mocker.MethodSeq(&net.TCPConn{}, "Close", []gomonkey.Params{{nil}})
-	assert.NotNil(t, PingIP("1.1.1.1", 80, time.Second))
-	assert.Nil(t, PingIP("1.1.1.1", 80, time.Second))
+	assert.NotNil(t, PingIP(context.Background(), "1.1.1.1", 80, time.Second))
+	assert.Nil(t, PingIP(context.Background(), "1.1.1.1", 80, time.Second))
 }
 
 func TestFastestPingIP(t *testing.T) {
@@ -52,10 +53,10 @@ func TestFastestPingIP(t *testing.T) {
 		return nil, errors.New("timeout")
 	})
 
-	ip, _, err := FastestPingIP([]string{"1.1.1.1", "1.1.1.2"}, port, timeout)
+	ip, _, err := FastestPingIP(context.Background(), []string{"1.1.1.1", "1.1.1.2"}, port, timeout)
 	assert.Nil(t, err)
 	assert.Equal(t, "1.1.1.1", ip)
 
-	_, _, err = FastestPingIP([]string{"1.1.1.2", "1.1.1.3"}, port, timeout)
+	_, _, err = FastestPingIP(context.Background(), []string{"1.1.1.2", "1.1.1.3"}, port, timeout)
 	assert.NotNil(t, err)
 }
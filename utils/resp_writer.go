@@ -7,8 +7,9 @@ import (
 )
 
 type FakeRespWriter struct {
-	Msg   *dns.Msg
-	Bytes []byte
+	Msg      *dns.Msg
+	Bytes    []byte
+	internal bool
 }
 
 // NewFakeRespWriter 创建一个FakeRespWriter，用于手动请求dns.Handler时获取DNS响应
@@ -16,6 +17,17 @@ func NewFakeRespWriter() *FakeRespWriter {
 	return &FakeRespWriter{}
 }
 
+// NewInternalRespWriter 创建一个标记为内部请求的FakeRespWriter，用于程序自身发起的查询（如解析DoH服务器域名）
+func NewInternalRespWriter() *FakeRespWriter {
+	return &FakeRespWriter{internal: true}
+}
+
+// IsInternal 判断请求是否由程序自身发起，内部请求不受客户端访问控制、限速及视图影响
+func IsInternal(writer dns.ResponseWriter) bool {
+	w, ok := writer.(*FakeRespWriter)
+	return ok && w.internal
+}
+
 func (w *FakeRespWriter) LocalAddr() net.Addr {
 	return &net.IPAddr{IP: []byte{127, 0, 0, 1}}
 }
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const traceKey ctxKey = "TS_TRACE"
+
+// Trace 单个请求的处理时间线，记录请求处理期间通过CtxDebug等函数输出的所有日志（不受日志级别限制）
+type Trace struct {
+	lock   sync.Mutex
+	begin  time.Time
+	record traceRecord
+}
+
+type traceRecord struct {
+	ID       string       `json:"id"`
+	Client   string       `json:"client,omitempty"`
+	Question string       `json:"question,omitempty"`
+	QType    string       `json:"q_type,omitempty"`
+	Begin    time.Time    `json:"begin"`
+	Cost     float64      `json:"cost_ms"` // 请求处理完成前为0
+	Events   []TraceEvent `json:"events"`
+}
+
+// TraceEvent 时间线中的一条记录
+type TraceEvent struct {
+	Elapsed  float64 `json:"elapsed_ms"` // 相对于请求开始的时间
+	Level    string  `json:"level"`
+	Location string  `json:"location"`
+	Message  string  `json:"message"`
+}
+
+// NewTrace 创建一个时间线，logID需与ctx内的log id一致
+func NewTrace(logID uint16, client string, req *dns.Msg) *Trace {
+	t := &Trace{begin: time.Now()}
+	t.record = traceRecord{ID: FormatLogID(logID), Client: client, Begin: t.begin, Events: []TraceEvent{}}
+	if len(req.Question) > 0 {
+		t.record.Question = req.Question[0].Name
+		t.record.QType = dns.TypeToString[req.Question[0].Qtype]
+	}
+	return t
+}
+
+// FormatLogID 将log id格式化为日志中的形式
+func FormatLogID(logID uint16) string {
+	return fmt.Sprintf("0x%04x", logID)
+}
+
+func (t *Trace) add(level logrus.Level, location, msg string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.record.Events = append(t.record.Events, TraceEvent{
+		Elapsed:  msSince(t.begin),
+		Level:    level.String(),
+		Location: location,
+		Message:  msg,
+	})
+}
+
+// ID 返回时间线对应的log id
+func (t *Trace) ID() string {
+	return t.record.ID
+}
+
+// Finish 记录请求处理的总耗时并返回，之后仍可追加记录（如被取消的上游请求）
+func (t *Trace) Finish() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cost := time.Since(t.begin)
+	t.record.Cost = float64(cost.Microseconds()) / 1000
+	return cost
+}
+
+// MarshalJSON 加锁后序列化，避免与后台goroutine追加记录冲突
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return json.Marshal(t.record)
+}
+
+func msSince(begin time.Time) float64 {
+	return float64(time.Since(begin).Microseconds()) / 1000
+}
+
+// WithTrace 在ctx内放入时间线，之后通过该ctx输出的日志均会记录到时间线中
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey, trace)
+}
+
+// CtxTrace 返回ctx内的时间线，不存在时返回nil
+func CtxTrace(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey).(*Trace)
+	return trace
+}
+
+// CtxLogID 返回ctx内的log id
+func CtxLogID(ctx context.Context) uint16 {
+	logID, _ := ctx.Value(logIDKey).(uint16)
+	return logID
+}
+
+// Detach 返回保留ctx内logger、log id、时间线等值，但不随ctx取消或超时的新ctx
+func Detach(ctx context.Context) context.Context {
+	return detachedCtx{parent: ctx}
+}
+
+type detachedCtx struct {
+	parent context.Context
+}
+
+func (c detachedCtx) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedCtx) Done() <-chan struct{}             { return nil }
+func (c detachedCtx) Err() error                        { return nil }
+func (c detachedCtx) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.InfoLevel)
+	req := new(dns.Msg)
+	req.SetQuestion("z.cn.", dns.TypeA)
+	trace := NewTrace(0x1234, "127.0.0.1:53", req)
+	assert.Equal(t, "0x1234", trace.ID())
+
+	ctx := WithTrace(NewCtx(logger, 0x1234), trace)
+	assert.Equal(t, trace, CtxTrace(ctx))
+	assert.Equal(t, uint16(0x1234), CtxLogID(ctx))
+	CtxDebug(ctx, "call %s", "upstream") // recorded even if debug level is disabled
+	CtxWarn(ctx, "failed")
+	CtxDebug(NewCtx(logger, 0x1234), "not recorded")
+	trace.Finish()
+
+	data, err := json.Marshal(trace)
+	assert.Nil(t, err)
+	record := traceRecord{}
+	assert.Nil(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "0x1234", record.ID)
+	assert.Equal(t, "z.cn.", record.Question)
+	assert.Equal(t, "A", record.QType)
+	assert.Equal(t, 2, len(record.Events))
+	assert.Equal(t, "debug", record.Events[0].Level)
+	assert.Equal(t, "call upstream", record.Events[0].Message)
+	assert.Contains(t, record.Events[0].Location, "trace_test.go:")
+	assert.Equal(t, "warning", record.Events[1].Level)
+}
+
+func TestDetach(t *testing.T) {
+	ctx, cancel := context.WithCancel(NewCtx(nil, 0x1234))
+	cancel()
+	detached := Detach(ctx)
+	assert.Nil(t, detached.Err())
+	assert.Nil(t, detached.Done())
+	_, ok := detached.Deadline()
+	assert.False(t, ok)
+	assert.Equal(t, uint16(0x1234), CtxLogID(detached))
+}